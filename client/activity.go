@@ -22,6 +22,7 @@ import (
 	"io"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -54,6 +55,12 @@ type Activity interface {
 	GetTrade() *Trade
 }
 
+// Returns whether the server refused an operation because this client's version is
+// too old for the article being traded. The server reports this as "client_outdated".
+func isClientOutdated(err error) bool {
+	return strings.Contains(err.Error(), "client_outdated")
+}
+
 // Struct ActivityState encapsulates status information on an activity which is displayed to the user.
 type ActivityState struct {
 	Type        string
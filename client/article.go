@@ -0,0 +1,95 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk-common/protocol"
+)
+
+// How long article settings fetched from the server are reused
+const articleInfoTTL = 10 * time.Minute
+
+// The part of an article's settings published by the server that the client uses.
+type articleInfo struct {
+	TickSize string
+	fetched  time.Time
+}
+
+var articleInfoMutex sync.Mutex
+var articleInfos = make(map[bitwrk.ArticleId]articleInfo)
+
+// Returns the settings of an article, as published by the server at /v2/article/.
+func getArticleInfo(article bitwrk.ArticleId) (articleInfo, error) {
+	articleInfoMutex.Lock()
+	defer articleInfoMutex.Unlock()
+	if info, ok := articleInfos[article]; ok && time.Since(info.fetched) < articleInfoTTL {
+		return info, nil
+	}
+
+	req, err := protocol.NewRequest("GET", protocol.BitwrkUrl+"v2/article/"+url.PathEscape(string(article)), nil)
+	if err != nil {
+		return articleInfo{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := protocol.NewClient(&http.Transport{}).Do(req)
+	if err != nil {
+		return articleInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return articleInfo{}, fmt.Errorf("Error fetching article %v: %v", article, resp.Status)
+	}
+
+	var info articleInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return articleInfo{}, err
+	}
+	info.fetched = time.Now()
+	articleInfos[article] = info
+	return info, nil
+}
+
+// Rounds a bid's price to a multiple of the article's tick size. Buy prices are
+// rounded down and sell prices up, so a bid never exceeds what its mandate allows.
+func roundPrice(price money.Money, bidType bitwrk.BidType, info articleInfo) (money.Money, error) {
+	if info.TickSize == "" {
+		return price, nil
+	}
+	tick, err := money.Parse(info.TickSize)
+	if err != nil {
+		return price, err
+	} else if tick.Currency != price.Currency || tick.Amount <= 0 {
+		return price, nil
+	}
+
+	if rest := price.Amount % tick.Amount; rest != 0 {
+		price.Amount -= rest
+		if bidType == bitwrk.Sell {
+			price.Amount += tick.Amount
+		}
+	}
+	return price, nil
+}
@@ -0,0 +1,123 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/indyjo/bitwrk-common/bitcoin"
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/protocol"
+)
+
+// Number of times a bid is sent before giving up, if the server can't be reached
+const placeBidAttempts = 3
+
+// Returns a random ID identifying a bid request across retries.
+func newRequestId() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// An error that occurred while talking to the server, after which it is unknown
+// whether the request has been processed.
+type transportError struct {
+	err error
+}
+
+func (e transportError) Error() string {
+	return e.err.Error()
+}
+
+// Places a bid, retrying if the server's response gets lost. All attempts carry the
+// same request ID, which makes the server return the bid created first instead of
+// creating (and paying for) another one. Returns the bid's ID.
+func placeBidIdempotently(rawBid *bitwrk.RawBid, identity *bitcoin.KeyPair) (string, error) {
+	requestId, err := newRequestId()
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 1; ; attempt++ {
+		bidId, err := placeBid(rawBid, identity, requestId)
+		if _, ok := err.(transportError); !ok || attempt == placeBidAttempts {
+			return bidId, err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// Sends a single bid request, signed with a fresh nonce.
+func placeBid(rawBid *bitwrk.RawBid, identity *bitcoin.KeyPair, requestId string) (string, error) {
+	nonce, err := protocol.GetNonce()
+	if err != nil {
+		return "", transportError{err}
+	}
+
+	bidType := "SELL"
+	if rawBid.Type == bitwrk.Buy {
+		bidType = "BUY"
+	}
+	price := strings.Replace(rawBid.Price.String(), " ", "", -1)
+
+	// The document must match what the server reconstructs from the parameters
+	document := fmt.Sprintf("article=%v&type=%v&price=%v&address=%v&nonce=%v&requestid=%v",
+		url.QueryEscape(string(rawBid.Article)), bidType, url.QueryEscape(price),
+		url.QueryEscape(identity.GetAddress()), url.QueryEscape(nonce), url.QueryEscape(requestId))
+	signature, err := identity.SignMessage(document, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	body := document + "&signature=" + url.QueryEscape(signature)
+	req, err := protocol.NewRequest("POST", protocol.BitwrkUrl+"bid", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// The server answers with a redirect to the bid, which we don't follow
+	client := protocol.NewClient(&http.Transport{})
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", transportError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSeeOther {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Server rejected bid (%v): %v", resp.Status, strings.TrimSpace(string(message)))
+	} else if bidId := resp.Header.Get("X-Bid-Key"); bidId == "" {
+		return "", fmt.Errorf("Server didn't return the bid's ID")
+	} else {
+		return bidId, nil
+	}
+}
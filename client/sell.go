@@ -21,9 +21,9 @@ import (
 	"github.com/indyjo/bitwrk/client/receiveman"
 	"io"
 
-	"github.com/indyjo/bitwrk-common/bitcoin"
 	"github.com/indyjo/bitwrk-common/bitwrk"
 	. "github.com/indyjo/bitwrk-common/protocol"
+	"github.com/indyjo/bitwrk/server/segwit"
 	"github.com/indyjo/cafs"
 )
 
@@ -211,7 +211,7 @@ func (a *SellActivity) HandleWork(log bitwrk.Logger, workFile cafs.File, buyerSe
 }
 
 func (a *SellActivity) HandleReceipt(log bitwrk.Logger, encResultHash, encResultHashSig string) error {
-	if err := bitcoin.VerifySignatureBase64(encResultHash, a.tx.Buyer, encResultHashSig); err != nil {
+	if err := segwit.VerifySignature(encResultHash, a.tx.Buyer, encResultHashSig); err != nil {
 		return err
 	}
 	if err := SendTxMessageTransmitFinished(a.txId, a.identity, encResultHash, encResultHashSig, a.encResultKey.String()); err != nil {
@@ -164,7 +164,18 @@ func (t *Trade) awaitBid() error {
 		Article: t.article,
 		Price:   t.price,
 	}
-	if bidId, err := protocol.PlaceBid(&rawBid, t.identity); err != nil {
+
+	// The server only accepts prices that are a multiple of the article's tick size.
+	// If the article's settings can't be fetched, the server will tell.
+	if info, err := getArticleInfo(t.article); err != nil {
+		bitwrk.Root().Printf("Error fetching settings of article %v: %v", t.article, err)
+	} else if price, err := roundPrice(rawBid.Price, t.bidType, info); err != nil {
+		return err
+	} else {
+		rawBid.Price = price
+	}
+
+	if bidId, err := placeBidIdempotently(&rawBid, t.identity); err != nil {
 		return err
 	} else {
 		t.bidId = bidId
@@ -398,6 +409,9 @@ func (t *Trade) GetState() *ActivityState {
 	info := ""
 	if t.lastError != nil {
 		info = t.lastError.Error()
+		if isClientOutdated(t.lastError) {
+			info = "Please upgrade your BitWrk client! " + info
+		}
 	}
 
 	phase := ""
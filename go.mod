@@ -4,7 +4,10 @@ go 1.12
 
 require (
 	bitbucket.org/ww/goautoneg v0.0.0-20120707110453-75cd24fc2f2c
+	github.com/btcsuite/btcd/btcec/v2 v2.3.2
+	github.com/btcsuite/btcd/btcutil v1.1.5
 	github.com/indyjo/bitwrk-common v0.0.2
 	github.com/indyjo/cafs v0.0.0-20190907155224-8998008871ee
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	google.golang.org/appengine v1.6.1
 )
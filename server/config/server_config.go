@@ -17,10 +17,103 @@
 // Package config contains settings that influence run-time behavior of the BitWrk server.
 package config
 
-const CfgBitcoinNetworkId byte = 0
+import "os"
+
+// Returns the value of the given environment variable, or def if it isn't set.
+func getenvDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// The Bitcoin network this server operates on: "mainnet", "testnet" or "regtest".
+// Determines which addresses are accepted.
+const CfgBitcoinNetwork = "mainnet"
+
 const CfgRequireValidNonce = true
 const CfgRequireValidSignature = true
 const CfgRequireValidWorkerURL = true
 
+// Retired transactions and their messages are archived after this many days.
+// Bids that expired without being matched are deleted.
+const CfgArchiveAfterDays = 90
+
+// Whether the server sends an OPTIONS request to a seller's announced worker URL,
+// rejecting the message if the worker doesn't answer.
+const CfgProbeWorkerURL = true
+
+// IP addresses or CIDR ranges of reverse proxies in front of the server. Requests from
+// these carry the client's address in "Forwarded" or "X-Forwarded-For", which is then
+// used instead of the connection's address. Empty when the server is reached directly.
+var CfgTrustedProxies = []string{}
+
 // Account ID that is trusted when receiving a deposit
 const CfgTrustedAccount = "1TrsjuCvBch1D9h6nRkadGKakv9KyaiP6"
+
+// Account ID that settles disputed transactions
+const CfgArbiterAccount = "1TrsjuCvBch1D9h6nRkadGKakv9KyaiP6"
+
+// Disputes the arbiter hasn't settled after this many days are settled by default:
+// In the seller's favor if delivery has been proven, in the buyer's favor otherwise.
+const CfgArbiterDeadlineDays = 14
+
+// Account ID that receives the fees charged on transactions. Must not be used for
+// anything else, as its balance is reported as fee revenue. Set environment variable
+// BITWRK_FEE_ACCOUNT (e.g. in app.yaml) to override the placeholder.
+var CfgFeeAccount = getenvDefault("BITWRK_FEE_ACCOUNT", "1DxRpLavsCTQFzBp3VprZXEyzs2DiELt6H")
+
+// Bearer token a metrics scraper must present to read /metrics. Set environment variable
+// BITWRK_METRICS_TOKEN (e.g. in app.yaml) to enable the endpoint; it refuses all requests
+// while the token is empty.
+var CfgMetricsToken = getenvDefault("BITWRK_METRICS_TOKEN", "")
+
+// Account ID that signs changes to the messages of the day
+const CfgAdminAccount = "1TrsjuCvBch1D9h6nRkadGKakv9KyaiP6"
+
+// Settings which may differ from article to article.
+type ArticleSettings struct {
+	// The rule for choosing a transaction's price from the two matched bids.
+	// One of "resting", "midpoint", "aggressor" or "buyer".
+	PriceRule string
+	// The oldest version of the BitWrk client (e.g. "0.6.4") allowed to place bids
+	// and send transaction messages. Empty if any version is allowed.
+	MinClientVersion string
+	// The fees paid by the buyer, in basis points (hundredths of a percent) of the
+	// transaction price. The maker fee applies if the buyer's bid rested in the book,
+	// the taker fee if it was matched on arrival.
+	MakerFeeBasisPoints int64
+	TakerFeeBasisPoints int64
+	// The range of prices accepted for bids, e.g. "mBTC0.01" and "mBTC100", and the
+	// step size prices must be a multiple of. Empty if not restricted.
+	MinPrice string
+	MaxPrice string
+	TickSize string
+}
+
+// Settings for all articles not listed in CfgArticleSettings
+var CfgDefaultArticleSettings = ArticleSettings{
+	PriceRule:           "resting",
+	MakerFeeBasisPoints: 300,
+	TakerFeeBasisPoints: 300,
+}
+
+// Article-specific settings, by article id
+var CfgArticleSettings = map[string]ArticleSettings{}
+
+// Returns the settings in force for the given article.
+func GetArticleSettings(article string) ArticleSettings {
+	if settings, ok := CfgArticleSettings[article]; ok {
+		return settings
+	}
+	return CfgDefaultArticleSettings
+}
+
+// Returns the higher of the maker and taker fees. Buy bids block this fee, as it is
+// not known in advance which of the two will apply.
+func (s ArticleSettings) MaxFeeBasisPoints() int64 {
+	if s.MakerFeeBasisPoints > s.TakerFeeBasisPoints {
+		return s.MakerFeeBasisPoints
+	}
+	return s.TakerFeeBasisPoints
+}
@@ -0,0 +1,152 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"google.golang.org/appengine/datastore"
+)
+
+// Types of agreements between buyer and seller of a transaction.
+const (
+	AgreementExtend = "extend" // Extends the current phase's deadline
+	AgreementCancel = "cancel" // Ends the transaction, reimbursing the buyer in full
+)
+
+// The longest extension a single agreement may grant.
+const MaxAgreedExtension = 60 * time.Minute
+
+// A message that only takes effect if signed by both buyer and seller. Both
+// sign the same document, which contains the transaction's revision so the
+// agreement can't be replayed.
+type TxAgreement struct {
+	Type            string
+	Extension       time.Duration // For AgreementExtend only
+	Revision        int
+	Document        string
+	BuyerAddress    string
+	BuyerSignature  string
+	SellerAddress   string
+	SellerSignature string
+}
+
+// Applies an agreement (whose signatures have been verified already) to a transaction
+// and records it as two messages, one per party.
+func AgreeOnTransaction(c context.Context, txKey *datastore.Key, now time.Time, agreement *TxAgreement) error {
+	var retired *Transaction
+	f := func(c context.Context) error {
+		retired = nil
+		tx, ext, err := GetTransaction(c, txKey)
+		if err != nil {
+			return err
+		}
+
+		if tx.State != StateActive {
+			return ErrTransactionAlreadyRetired
+		} else if agreement.Revision != tx.Revision {
+			return &ConflictError{fmt.Sprintf("Agreement refers to revision %v, but transaction is at revision %v",
+				agreement.Revision, tx.Revision)}
+		}
+
+		if buyer, err := transactionSender(c, tx, agreement.BuyerAddress); err != nil {
+			return err
+		} else if buyer != tx.Buyer {
+			return &PermissionError{fmt.Sprintf("%v may not sign on behalf of the buyer", agreement.BuyerAddress)}
+		}
+		if seller, err := transactionSender(c, tx, agreement.SellerAddress); err != nil {
+			return err
+		} else if seller != tx.Seller {
+			return &PermissionError{fmt.Sprintf("%v may not sign on behalf of the seller", agreement.SellerAddress)}
+		}
+
+		phase := tx.Phase
+		dao := NewGaeAccountingDao(c, true)
+		switch agreement.Type {
+		case AgreementExtend:
+			if ext.Dispute == DisputeOpen {
+				return ErrTransactionDisputed
+			} else if agreement.Extension <= 0 || agreement.Extension > MaxAgreedExtension {
+				return fmt.Errorf("Extension must be positive and may not exceed %v", MaxAgreedExtension)
+			} else if !tx.Timeout.After(now) {
+				return ErrTransactionTooOld
+			}
+			tx.Timeout = tx.Timeout.Add(agreement.Extension)
+		case AgreementCancel:
+			if _, err := settleTransaction(dao, txKey.Encode(), tx, money.Money{Currency: tx.Price.Currency}, now); err != nil {
+				return err
+			}
+			ext.Retired = now
+			if err := addAggregatePriceTask(c, txKey.Encode(), tx); err != nil {
+				return err
+			}
+			retired = tx
+			if ext.Dispute == DisputeOpen {
+				// Both parties have resolved the dispute themselves
+				ext.Dispute = DisputeSettled
+			}
+		default:
+			return fmt.Errorf("Unknown agreement: %#v", agreement.Type)
+		}
+		tx.Revision++
+
+		for _, m := range []struct {
+			from      Origin
+			signature string
+		}{
+			{FromBuyer, agreement.BuyerSignature},
+			{FromSeller, agreement.SellerSignature},
+		} {
+			message := Tmessage{
+				Received:  now,
+				From:      m.from,
+				Document:  agreement.Document,
+				Signature: m.signature,
+				Accepted:  true,
+				PrePhase:  phase,
+				PostPhase: tx.Phase,
+			}
+			if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tmessage", txKey), &message); err != nil {
+				return err
+			}
+		}
+
+		if _, err := datastore.Put(c, txKey, datastore.PropertyLoadSaver(txCodec{tx, ext})); err != nil {
+			return err
+		}
+
+		if tx.State == StateActive {
+			// The previously scheduled retirement will find the transaction too young
+			if err := addRetireTransactionTask(c, txKey.Encode(), tx); err != nil {
+				return err
+			}
+		}
+
+		return dao.Flush()
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	countRetiredTransaction(retired)
+	return nil
+}
@@ -0,0 +1,251 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// A compact record replacing a retired transaction and its messages once they have
+// been pruned. It keeps what price statistics and the ledger need. Archived
+// transactions keep the ID of the original transaction, and their bids are kept so
+// that links to them stay valid.
+type ArchivedTx struct {
+	Article    string
+	Currency   string
+	Matched    time.Time
+	Price      int64          `datastore:",noindex"`
+	Fee        int64          `datastore:",noindex"`
+	ChargedFee int64          `datastore:",noindex"`
+	Phase      int64          `datastore:",noindex"` // The phase the transaction ended in
+	Buyer      string         `datastore:",noindex"`
+	Seller     string         `datastore:",noindex"`
+	BuyerBid   *datastore.Key `datastore:",noindex"`
+	SellerBid  *datastore.Key `datastore:",noindex"`
+	PriceRule  string         `datastore:",noindex"`
+	FeeRole    string         `datastore:",noindex"`
+	Messages   int            `datastore:",noindex"` // Number of messages pruned
+	Retired    time.Time      `datastore:",noindex"`
+}
+
+// Remembers where pruning of expired bids continues.
+type archiveState struct {
+	BidCursor string `datastore:",noindex"`
+}
+
+func archivedTxKey(c context.Context, txKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "ArchivedTx", txKey.StringID(), txKey.IntID(), nil)
+}
+
+func archiveStateKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "ArchiveState", "state", 0, nil)
+}
+
+func newArchivedTx(tx *Transaction, ext *TxExtension, messages int) *ArchivedTx {
+	return &ArchivedTx{
+		Article:    string(tx.Article),
+		Currency:   tx.Price.Currency.String(),
+		Matched:    tx.Matched,
+		Price:      tx.Price.Amount,
+		Fee:        tx.Fee.Amount,
+		ChargedFee: ChargedFee(tx, ext).Amount,
+		Phase:      int64(tx.Phase),
+		Buyer:      tx.Buyer,
+		Seller:     tx.Seller,
+		BuyerBid:   mustDecodeKey(&tx.BuyerBid),
+		SellerBid:  mustDecodeKey(&tx.SellerBid),
+		PriceRule:  string(ext.PriceRule),
+		FeeRole:    string(ext.FeeRole),
+		Messages:   messages,
+		Retired:    ext.Retired,
+	}
+}
+
+// Restores as much of the original transaction as has been kept.
+func (a *ArchivedTx) transaction() (*Transaction, *TxExtension) {
+	var currency money.Currency
+	currency.MustParse(a.Currency)
+	tx := &Transaction{
+		BuyerBid:  a.BuyerBid.Encode(),
+		SellerBid: a.SellerBid.Encode(),
+		Buyer:     a.Buyer,
+		Seller:    a.Seller,
+		Article:   ArticleId(a.Article),
+		Price:     money.Money{Currency: currency, Amount: a.Price},
+		Fee:       money.Money{Currency: currency, Amount: a.Fee},
+		Matched:   a.Matched,
+		State:     StateRetired,
+		Phase:     TxPhase(a.Phase),
+	}
+	ext := &TxExtension{
+		PriceRule:    PriceRule(a.PriceRule),
+		FeeRole:      FeeRole(a.FeeRole),
+		ChargedFee:   money.Money{Currency: currency, Amount: a.ChargedFee},
+		FeeCollected: true,
+		Aggregated:   true,
+
+		RetirementAggregated: true,
+		Retired:              a.Retired,
+		Archived:             true,
+	}
+	return tx, ext
+}
+
+// Archives up to limit transactions matched before the cutoff, continuing at the
+// given cursor. Transactions still active, disputed, waiting for their fee to be
+// collected or not yet added to the price statistics are left alone. Returns the
+// number of transactions archived and the cursor to continue with, which is empty
+// if there are no more transactions to look at.
+func ArchiveTransactions(c context.Context, cutoff time.Time, cursor string, limit int) (int, string, error) {
+	query := datastore.NewQuery("Tx").Filter("Matched <", cutoff).Order("Matched").KeysOnly().Limit(limit)
+	if cursor != "" {
+		if cur, err := datastore.DecodeCursor(cursor); err != nil {
+			return 0, "", err
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	archived, count := 0, 0
+	for {
+		key, err := iter.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return archived, "", err
+		}
+		count++
+		if ok, err := archiveTransaction(c, key); err != nil {
+			return archived, "", err
+		} else if ok {
+			archived++
+		}
+	}
+
+	if count < limit {
+		return archived, "", nil
+	} else if cur, err := iter.Cursor(); err != nil {
+		return archived, "", err
+	} else {
+		return archived, cur.String(), nil
+	}
+}
+
+// Replaces a transaction and its messages by an archive record.
+func archiveTransaction(c context.Context, key *datastore.Key) (bool, error) {
+	archived := false
+	f := func(c context.Context) error {
+		archived = false
+		tx, ext, err := GetTransaction(c, key)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		} else if ext.Archived {
+			return nil
+		}
+		if tx.State != StateRetired || ext.Dispute == DisputeOpen {
+			return nil
+		} else if !ext.FeeCollected && ext.ChargedFee.Amount != 0 {
+			return nil
+		} else if !ext.Aggregated || !ext.RetirementAggregated {
+			return nil
+		}
+
+		messageKeys, err := datastore.NewQuery("Tmessage").Ancestor(key).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := datastore.Put(c, archivedTxKey(c, key), newArchivedTx(tx, ext, len(messageKeys))); err != nil {
+			return err
+		}
+
+		if err := datastore.DeleteMulti(c, append(messageKeys, key)); err != nil {
+			return err
+		}
+		archived = true
+		return nil
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return false, err
+	}
+	return archived, nil
+}
+
+// Deletes up to limit bids that expired before the cutoff without being matched.
+// Bids are scanned in batches, continuing where the previous call stopped. Returns
+// the number of bids deleted and whether all bids have been scanned.
+func PruneExpiredBids(c context.Context, cutoff time.Time, limit int) (int, bool, error) {
+	var state archiveState
+	if err := datastore.Get(c, archiveStateKey(c), &state); err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, false, err
+	}
+
+	query := datastore.NewQuery("Bid").Order("__key__").Limit(limit)
+	if state.BidCursor != "" {
+		if cur, err := datastore.DecodeCursor(state.BidCursor); err != nil {
+			log.Warningf(c, "Discarding invalid bid cursor: %v", err)
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	pruned := make([]*datastore.Key, 0, limit)
+	count := 0
+	for {
+		var bid Bid
+		key, err := iter.Next(bidCodec{&bid, nil})
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return 0, false, err
+		}
+		count++
+		if bid.State == Expired && bid.Transaction == nil && bid.Expires.Before(cutoff) {
+			pruned = append(pruned, key)
+		}
+	}
+
+	if len(pruned) > 0 {
+		if err := datastore.DeleteMulti(c, pruned); err != nil {
+			return 0, false, err
+		}
+	}
+
+	done := count < limit
+	if done {
+		state.BidCursor = ""
+	} else if cur, err := iter.Cursor(); err != nil {
+		return len(pruned), false, err
+	} else {
+		state.BidCursor = cur.String()
+	}
+	if _, err := datastore.Put(c, archiveStateKey(c), &state); err != nil {
+		return len(pruned), false, err
+	}
+	return len(pruned), done, nil
+}
@@ -0,0 +1,87 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk/server/metrics"
+	"google.golang.org/appengine/datastore"
+)
+
+// Maximum number of bids enqueued in one datastore transaction. Each bid adds two
+// tasks, and App Engine allows no more than five tasks per transaction.
+const maxBidsPerTransaction = 2
+
+// The outcome of enqueuing one bid of a batch. See EnqueueBid.
+type EnqueueResult struct {
+	Key     *datastore.Key
+	Created bool
+	Err     error
+}
+
+// Enqueues a number of bids. Bids are booked in groups sharing a transaction. If a
+// group fails, its bids are enqueued one by one, so that a bad bid doesn't affect
+// the others. Returns one result per bid.
+func EnqueueBids(c context.Context, bids []*Bid, exts []*BidExtension) []EnqueueResult {
+	results := make([]EnqueueResult, len(bids))
+	for start := 0; start < len(bids); start += maxBidsPerTransaction {
+		end := start + maxBidsPerTransaction
+		if end > len(bids) {
+			end = len(bids)
+		}
+		if err := enqueueBidGroup(c, bids[start:end], exts[start:end], results[start:end]); err == nil {
+			continue
+		}
+
+		for i := start; i < end; i++ {
+			key, created, err := EnqueueBid(c, bids[i], exts[i])
+			results[i] = EnqueueResult{key, created, err}
+		}
+	}
+	return results
+}
+
+// Enqueues a group of bids in a single transaction. Results are filled in only
+// if the transaction succeeds.
+func enqueueBidGroup(c context.Context, bids []*Bid, exts []*BidExtension, results []EnqueueResult) error {
+	groupResults := make([]EnqueueResult, len(bids))
+	f := func(c context.Context) error {
+		dao := NewGaeAccountingDao(c, true)
+		for i, bid := range bids {
+			if key, created, err := enqueueBid(c, dao, bid, exts[i]); err != nil {
+				return err
+			} else {
+				groupResults[i] = EnqueueResult{key, created, nil}
+			}
+		}
+		return dao.Flush()
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	for i, result := range groupResults {
+		if result.Created {
+			metrics.BidsEnqueued.Inc(string(bids[i].Article), bids[i].Type.String())
+		}
+	}
+	copy(results, groupResults)
+	return nil
+}
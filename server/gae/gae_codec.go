@@ -39,12 +39,32 @@ func mustDecodeKey(s *string) *datastore.Key {
 	return nil // never reached
 }
 
+// Server-side information that is stored in the "Bid" entity alongside a Bid,
+// but is not part of the bid model shared with clients.
+type BidExtension struct {
+	Counterparty string // If non-empty, the only participant the bid may be matched with
+	Signer       string // If non-empty, the team member who placed the bid on the participant's behalf
+	RequestId    string // If non-empty, the client-supplied ID under which the bid was requested
+	// If non-empty, the network address the bid's nonce was issued to. Stored for the
+	// self-dealing detector only and never rendered to clients.
+	RemoteAddr string `json:"-"`
+}
+
+// Returned when saving a bid or transaction without its extension
+var errSaveWithoutExtension = fmt.Errorf("Entity can't be saved without its extension")
+
+// Returned when saving a transaction restored from the archive, which is read-only
+var errSaveArchived = fmt.Errorf("Archived transactions can't be saved")
+
+// Codec for bids. Just like with txCodec, the extension may be nil when loading,
+// in which case extension properties are ignored. Saving requires an extension.
 type bidCodec struct {
 	bid *Bid
+	ext *BidExtension
 }
 
 // Make sure datastore.PropertyLoadSaver is supported
-var _ datastore.PropertyLoadSaver = bidCodec{nil}
+var _ datastore.PropertyLoadSaver = bidCodec{nil, nil}
 
 func (codec bidCodec) Load(props []datastore.Property) error {
 	bid := codec.bid
@@ -89,6 +109,22 @@ func (codec bidCodec) Load(props []datastore.Property) error {
 				s := p.Value.(*datastore.Key).Encode()
 				bid.Transaction = &s
 			}
+		case "Counterparty":
+			if codec.ext != nil {
+				codec.ext.Counterparty = p.Value.(string)
+			}
+		case "Signer":
+			if codec.ext != nil {
+				codec.ext.Signer = p.Value.(string)
+			}
+		case "RequestId":
+			if codec.ext != nil {
+				codec.ext.RequestId = p.Value.(string)
+			}
+		case "RemoteAddr":
+			if codec.ext != nil {
+				codec.ext.RemoteAddr = p.Value.(string)
+			}
 		default:
 			return fmt.Errorf("Unknown property %s", p.Name)
 		}
@@ -97,12 +133,17 @@ func (codec bidCodec) Load(props []datastore.Property) error {
 	return nil
 }
 
+// Save a Bid object. Participant and State are indexed for finding a participant's
+// unmatched bids.
 func (codec bidCodec) Save() ([]datastore.Property, error) {
+	if codec.ext == nil {
+		return nil, errSaveWithoutExtension
+	}
 	bid := codec.bid
 	props := make([]datastore.Property, 0, 13)
 	props = append(props,
 		datastore.Property{Name: "Type", Value: int64(bid.Type), NoIndex: true},
-		datastore.Property{Name: "State", Value: int64(bid.State), NoIndex: true},
+		datastore.Property{Name: "State", Value: int64(bid.State)},
 		datastore.Property{Name: "Article", Value: string(bid.Article), NoIndex: true})
 	if bid.Price.Currency != money.BTC {
 		props = append(props,
@@ -111,7 +152,7 @@ func (codec bidCodec) Save() ([]datastore.Property, error) {
 	props = append(props,
 		datastore.Property{Name: "Price", Value: bid.Price.Amount, NoIndex: true},
 		datastore.Property{Name: "Fee", Value: bid.Fee.Amount, NoIndex: true},
-		datastore.Property{Name: "Participant", Value: string(bid.Participant), NoIndex: true},
+		datastore.Property{Name: "Participant", Value: string(bid.Participant)},
 		datastore.Property{Name: "Document", Value: string(bid.Document), NoIndex: true},
 		datastore.Property{Name: "Signature", Value: bid.Signature, NoIndex: true},
 		datastore.Property{Name: "Created", Value: time.Time(bid.Created)},
@@ -122,6 +163,22 @@ func (codec bidCodec) Save() ([]datastore.Property, error) {
 	}
 	props = append(props,
 		datastore.Property{Name: "Transaction", Value: mustDecodeKey(bid.Transaction), NoIndex: true})
+	if codec.ext != nil && codec.ext.Counterparty != "" {
+		props = append(props,
+			datastore.Property{Name: "Counterparty", Value: codec.ext.Counterparty, NoIndex: true})
+	}
+	if codec.ext != nil && codec.ext.Signer != "" {
+		props = append(props,
+			datastore.Property{Name: "Signer", Value: codec.ext.Signer, NoIndex: true})
+	}
+	if codec.ext != nil && codec.ext.RequestId != "" {
+		props = append(props,
+			datastore.Property{Name: "RequestId", Value: codec.ext.RequestId, NoIndex: true})
+	}
+	if codec.ext != nil && codec.ext.RemoteAddr != "" {
+		props = append(props,
+			datastore.Property{Name: "RemoteAddr", Value: codec.ext.RemoteAddr, NoIndex: true})
+	}
 	return props, nil
 }
 
@@ -147,6 +204,12 @@ func (codec hotBidCodec) Load(props []datastore.Property) error {
 			bid.Price.Amount = p.Value.(int64)
 		case "Expires":
 			bid.Expires = p.Value.(time.Time)
+		case "Lane":
+			bid.Lane = p.Value.(string)
+		case "Participant":
+			bid.Participant = p.Value.(string)
+		case "Signer":
+			bid.Signer = p.Value.(string)
 		default:
 			return fmt.Errorf("Unknown property %s", p.Name)
 		}
@@ -157,22 +220,53 @@ func (codec hotBidCodec) Load(props []datastore.Property) error {
 
 func (codec hotBidCodec) Save() ([]datastore.Property, error) {
 	bid := codec.bid
-	props := make([]datastore.Property, 0, 5)
+	props := make([]datastore.Property, 0, 8)
 	props = append(props,
 		datastore.Property{Name: "BidKey", Value: bid.BidKey, NoIndex: true},
+		datastore.Property{Name: "Lane", Value: bid.Lane},
 		datastore.Property{Name: "Type", Value: int64(bid.Type)},
 		datastore.Property{Name: "Currency", Value: bid.Price.Currency.String()},
 		datastore.Property{Name: "Price", Value: bid.Price.Amount},
 		datastore.Property{Name: "Expires", Value: time.Time(bid.Expires)})
+	if bid.Participant != "" {
+		props = append(props,
+			datastore.Property{Name: "Participant", Value: bid.Participant, NoIndex: true})
+	}
+	if bid.Signer != "" {
+		props = append(props,
+			datastore.Property{Name: "Signer", Value: bid.Signer, NoIndex: true})
+	}
 	return props, nil
 }
 
+// Server-side information that is stored in the "Tx" entity alongside a Transaction,
+// but is not part of the transaction model shared with clients.
+type TxExtension struct {
+	PriceRule            PriceRule    // The rule that decided the transaction's price
+	Dispute              DisputeState // Whether the transaction is (or was) disputed
+	DisputeOpened        time.Time    // When the dispute was opened
+	Rejected             bool         // Whether the buyer rejected the result, or the seller the work
+	SellerShare          money.Money  // The part of the price the arbiter awarded to the seller
+	Arbiter              string       // Who settled the dispute; empty if it was settled by default
+	FeeRole              FeeRole      // Whether the buyer paid the maker or the taker fee
+	ChargedFee           money.Money  // The fee actually charged when the transaction was retired
+	FeeCollected         bool         // Whether the charged fee has been credited to the fee account
+	Aggregated           bool         // Whether the price has been added to the price statistics
+	RetirementAggregated bool         // Whether the fee and outcome have been added to the price statistics
+	Retired              time.Time    // When the transaction was retired, if known
+	Archived             bool         // Whether restored from the archive, which makes it read-only
+}
+
+// Codec for transactions. The extension may be nil when loading, in which case
+// extension properties are ignored. Saving requires an extension, as the entity's
+// extension properties would be lost otherwise.
 type txCodec struct {
-	tx *Transaction
+	tx  *Transaction
+	ext *TxExtension
 }
 
 // Make sure that datastore.PropertyLoadSaver is implemented.
-var _ datastore.PropertyLoadSaver = txCodec{nil}
+var _ datastore.PropertyLoadSaver = txCodec{nil, nil}
 
 func (codec txCodec) Load(props []datastore.Property) error {
 	tx := codec.tx
@@ -236,32 +330,92 @@ func (codec txCodec) Load(props []datastore.Property) error {
 		case "ResultDecryptionKey":
 			tx.ResultDecryptionKey = new(Tkey)
 			copy(tx.ResultDecryptionKey[:], p.Value.([]byte))
+		case "PriceRule":
+			if codec.ext != nil {
+				codec.ext.PriceRule = PriceRule(p.Value.(string))
+			}
+		case "Dispute":
+			if codec.ext != nil {
+				codec.ext.Dispute = DisputeState(p.Value.(string))
+			}
+		case "DisputeOpened":
+			if codec.ext != nil {
+				codec.ext.DisputeOpened = p.Value.(time.Time)
+			}
+		case "Rejected":
+			if codec.ext != nil {
+				codec.ext.Rejected = p.Value.(bool)
+			}
+		case "SellerShare":
+			if codec.ext != nil {
+				codec.ext.SellerShare.Amount = p.Value.(int64)
+			}
+		case "Arbiter":
+			if codec.ext != nil {
+				codec.ext.Arbiter = p.Value.(string)
+			}
+		case "FeeRole":
+			if codec.ext != nil {
+				codec.ext.FeeRole = FeeRole(p.Value.(string))
+			}
+		case "ChargedFee":
+			if codec.ext != nil {
+				codec.ext.ChargedFee.Amount = p.Value.(int64)
+			}
+		case "FeeCollected":
+			if codec.ext != nil {
+				codec.ext.FeeCollected = p.Value.(bool)
+			}
+		case "Aggregated":
+			if codec.ext != nil {
+				codec.ext.Aggregated = p.Value.(bool)
+			}
+		case "RetirementAggregated":
+			if codec.ext != nil {
+				codec.ext.RetirementAggregated = p.Value.(bool)
+			}
+		case "Retired":
+			if codec.ext != nil {
+				codec.ext.Retired = p.Value.(time.Time)
+			}
 		default:
 			return fmt.Errorf("Unknown property %s", p.Name)
 		}
 	}
 
+	if codec.ext != nil {
+		codec.ext.SellerShare.Currency = tx.Price.Currency
+		codec.ext.ChargedFee.Currency = tx.Price.Currency
+	}
+
 	return nil
 }
 
 // Save a Transaction object. For the sake of cost reduction, the only indexed properties are:
 // - Article
 // - Matched
+// - Buyer, Seller and State (for finding a participant's active transactions)
+// - Retired (for the public trades feed)
 func (codec txCodec) Save() ([]datastore.Property, error) {
+	if codec.ext == nil {
+		return nil, errSaveWithoutExtension
+	} else if codec.ext.Archived {
+		return nil, errSaveArchived
+	}
 	tx := codec.tx
 	props := make([]datastore.Property, 0, 20)
 	props = append(props,
 		datastore.Property{Name: "Revision", Value: int64(tx.Revision), NoIndex: true},
 		datastore.Property{Name: "BuyerBid", Value: mustDecodeKey(&tx.BuyerBid), NoIndex: true},
 		datastore.Property{Name: "SellerBid", Value: mustDecodeKey(&tx.SellerBid), NoIndex: true},
-		datastore.Property{Name: "Buyer", Value: tx.Buyer, NoIndex: true},
-		datastore.Property{Name: "Seller", Value: tx.Seller, NoIndex: true},
+		datastore.Property{Name: "Buyer", Value: tx.Buyer},
+		datastore.Property{Name: "Seller", Value: tx.Seller},
 		datastore.Property{Name: "Article", Value: string(tx.Article)},
 		datastore.Property{Name: "Currency", Value: tx.Price.Currency.String()},
 		datastore.Property{Name: "Price", Value: tx.Price.Amount, NoIndex: true},
 		datastore.Property{Name: "Fee", Value: tx.Fee.Amount, NoIndex: true},
 		datastore.Property{Name: "Matched", Value: tx.Matched},
-		datastore.Property{Name: "State", Value: int64(tx.State), NoIndex: true},
+		datastore.Property{Name: "State", Value: int64(tx.State)},
 		datastore.Property{Name: "Phase", Value: int64(tx.Phase), NoIndex: true},
 		datastore.Property{Name: "Timeout", Value: tx.Timeout, NoIndex: true})
 	if tx.WorkerURL != nil {
@@ -286,6 +440,47 @@ func (codec txCodec) Save() ([]datastore.Property, error) {
 			datastore.Property{Name: "EncryptedResultHashSignature", Value: tx.EncryptedResultReceipt.HashSignature[:], NoIndex: true},
 			datastore.Property{Name: "ResultDecryptionKey", Value: tx.ResultDecryptionKey[:], NoIndex: true})
 	}
+	if ext := codec.ext; ext != nil {
+		if ext.PriceRule != "" {
+			props = append(props,
+				datastore.Property{Name: "PriceRule", Value: string(ext.PriceRule), NoIndex: true})
+		}
+		if ext.Dispute != DisputeNone {
+			props = append(props,
+				datastore.Property{Name: "Dispute", Value: string(ext.Dispute), NoIndex: true},
+				datastore.Property{Name: "DisputeOpened", Value: ext.DisputeOpened, NoIndex: true},
+				datastore.Property{Name: "SellerShare", Value: ext.SellerShare.Amount, NoIndex: true})
+		}
+		if ext.Arbiter != "" {
+			props = append(props,
+				datastore.Property{Name: "Arbiter", Value: ext.Arbiter, NoIndex: true})
+		}
+		if ext.Rejected {
+			props = append(props,
+				datastore.Property{Name: "Rejected", Value: true, NoIndex: true})
+		}
+		if ext.FeeRole != "" {
+			props = append(props,
+				datastore.Property{Name: "FeeRole", Value: string(ext.FeeRole), NoIndex: true})
+		}
+		if ext.ChargedFee.Amount != 0 {
+			props = append(props,
+				datastore.Property{Name: "ChargedFee", Value: ext.ChargedFee.Amount, NoIndex: true},
+				datastore.Property{Name: "FeeCollected", Value: ext.FeeCollected, NoIndex: true})
+		}
+		if ext.Aggregated {
+			props = append(props,
+				datastore.Property{Name: "Aggregated", Value: true, NoIndex: true})
+		}
+		if ext.RetirementAggregated {
+			props = append(props,
+				datastore.Property{Name: "RetirementAggregated", Value: true, NoIndex: true})
+		}
+		if !ext.Retired.IsZero() {
+			props = append(props,
+				datastore.Property{Name: "Retired", Value: ext.Retired})
+		}
+	}
 	return props, nil
 }
 
@@ -518,3 +713,79 @@ func (codec depositCodec) Load(props []datastore.Property) error {
 
 	return nil
 }
+
+// Codec for teams. Members are stored as a set of multi-valued properties, one
+// value per member and property.
+type teamCodec struct {
+	team *Team
+}
+
+// Make sure datastore.PropertyLoadSaver is implemented.
+var _ datastore.PropertyLoadSaver = teamCodec{nil}
+
+func (codec teamCodec) Save() ([]datastore.Property, error) {
+	team := codec.team
+	props := make([]datastore.Property, 0, 3+6*len(team.Members))
+	props = append(props,
+		datastore.Property{Name: "Document", Value: team.Document, NoIndex: true},
+		datastore.Property{Name: "Signature", Value: team.Signature, NoIndex: true},
+		datastore.Property{Name: "Updated", Value: team.Updated, NoIndex: true})
+	for _, m := range team.Members {
+		props = append(props,
+			datastore.Property{Name: "MemberAddress", Value: m.Address, NoIndex: true, Multiple: true},
+			datastore.Property{Name: "MemberDailyLimit", Value: m.DailyLimit.Amount, NoIndex: true, Multiple: true},
+			datastore.Property{Name: "MemberTotalLimit", Value: m.TotalLimit.Amount, NoIndex: true, Multiple: true},
+			datastore.Property{Name: "MemberDay", Value: m.Day, NoIndex: true, Multiple: true},
+			datastore.Property{Name: "MemberSpentToday", Value: m.SpentToday.Amount, NoIndex: true, Multiple: true},
+			datastore.Property{Name: "MemberSpentTotal", Value: m.SpentTotal.Amount, NoIndex: true, Multiple: true})
+	}
+	return props, nil
+}
+
+func (codec teamCodec) Load(props []datastore.Property) error {
+	team := codec.team
+	team.Members = team.Members[:0]
+
+	// Returns the member that the next value of the given property belongs to
+	counts := make(map[string]int)
+	member := func(name string) *TeamMember {
+		index := counts[name]
+		counts[name] = index + 1
+		for len(team.Members) <= index {
+			var m TeamMember
+			m.DailyLimit.Currency = money.BTC
+			m.TotalLimit.Currency = money.BTC
+			m.SpentToday.Currency = money.BTC
+			m.SpentTotal.Currency = money.BTC
+			team.Members = append(team.Members, m)
+		}
+		return &team.Members[index]
+	}
+
+	for _, p := range props {
+		switch p.Name {
+		case "Document":
+			team.Document = p.Value.(string)
+		case "Signature":
+			team.Signature = p.Value.(string)
+		case "Updated":
+			team.Updated = p.Value.(time.Time)
+		case "MemberAddress":
+			member(p.Name).Address = p.Value.(string)
+		case "MemberDailyLimit":
+			member(p.Name).DailyLimit.Amount = p.Value.(int64)
+		case "MemberTotalLimit":
+			member(p.Name).TotalLimit.Amount = p.Value.(int64)
+		case "MemberDay":
+			member(p.Name).Day = p.Value.(string)
+		case "MemberSpentToday":
+			member(p.Name).SpentToday.Amount = p.Value.(int64)
+		case "MemberSpentTotal":
+			member(p.Name).SpentTotal.Amount = p.Value.(int64)
+		default:
+			return fmt.Errorf("Unknown property %s", p.Name)
+		}
+	}
+
+	return nil
+}
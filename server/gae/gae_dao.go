@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk/server/metrics"
 	"google.golang.org/appengine/datastore"
 )
 
@@ -67,6 +68,15 @@ func (dao *gaeAccountingDao) SaveMovement(movement *AccountMovement) (err error)
 		return
 	}
 	_, err = datastore.Put(dao.c, key, datastore.PropertyLoadSaver(movementCodec{dao.c, movement}))
+	if err == nil {
+		currency := movement.AvailableDelta.Currency.String()
+		volume := movement.AvailableDelta.Amount
+		if volume < 0 {
+			volume = -volume
+		}
+		metrics.LedgerMovements.Inc(currency)
+		metrics.LedgerVolume.Add(float64(volume), currency)
+	}
 	return
 }
 
@@ -0,0 +1,239 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+	"google.golang.org/appengine/datastore"
+)
+
+// While a transaction is disputed, it isn't retired and the buyer's funds stay
+// blocked. Only the arbiter can end a dispute, by settling the transaction. If the
+// arbiter doesn't within CfgArbiterDeadlineDays, the dispute is settled by default.
+type DisputeState string
+
+const (
+	DisputeNone    DisputeState = ""
+	DisputeOpen    DisputeState = "open"
+	DisputeSettled DisputeState = "settled"
+)
+
+// Maximum length of a single piece of evidence
+const MaxEvidenceLength = 1000
+
+var ErrTransactionDisputed = fmt.Errorf("Transaction is disputed and must be settled by the arbiter")
+
+// Whether the seller has proven that the buyer received the result: The buyer
+// signed a receipt for the encrypted result, and the seller released the key.
+func deliveryProven(tx *Transaction) bool {
+	return tx.EncryptedResultReceipt != nil && tx.ResultDecryptionKey != nil
+}
+
+// Opens a dispute, unless there is one, and schedules its default settlement.
+// Must be called inside a transaction.
+func openDispute(c context.Context, txKey *datastore.Key, tx *Transaction, ext *TxExtension, now time.Time) error {
+	if ext.Dispute != DisputeNone {
+		return nil
+	}
+	ext.Dispute = DisputeOpen
+	ext.DisputeOpened = now
+	return addSettleDisputeTask(c, txKey.Encode(), tx, disputeDeadline(ext))
+}
+
+// Returns when a dispute is settled by default if the arbiter hasn't settled it.
+func disputeDeadline(ext *TxExtension) time.Time {
+	return ext.DisputeOpened.Add(config.CfgArbiterDeadlineDays * 24 * time.Hour)
+}
+
+// Records a piece of evidence sent by buyer or seller, opening a dispute if there
+// isn't one already. Disputes can only be opened after the buyer has rejected the
+// result, or the seller the work. Evidence is free text, such as hashes of sample
+// outputs or an excerpt of a log file. It is stored in the transaction's message history.
+func SubmitEvidence(c context.Context, txKey *datastore.Key, now time.Time,
+	address, document, signature string) error {
+
+	f := func(c context.Context) error {
+		tx, ext, err := GetTransaction(c, txKey)
+		if err != nil {
+			return err
+		}
+
+		sender, err := transactionSender(c, tx, address)
+		if err != nil {
+			return err
+		} else if sender != tx.Buyer && sender != tx.Seller {
+			return &PermissionError{"Only buyer and seller may submit evidence"}
+		} else if tx.State != StateActive {
+			return ErrTransactionAlreadyRetired
+		} else if ext.Dispute == DisputeSettled {
+			return &ConflictError{"Dispute has been settled already"}
+		} else if ext.Dispute == DisputeNone && !ext.Rejected {
+			return &ConflictError{"A dispute can only be opened after the result or the work has been rejected"}
+		}
+
+		if err := openDispute(c, txKey, tx, ext, now); err != nil {
+			return err
+		}
+		tx.Revision++
+
+		message := Tmessage{
+			Received:  now,
+			From:      tx.Identify(sender),
+			Document:  document,
+			Signature: signature,
+			Accepted:  true,
+			PrePhase:  tx.Phase,
+			PostPhase: tx.Phase,
+		}
+		if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tmessage", txKey), &message); err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(c, txKey, datastore.PropertyLoadSaver(txCodec{tx, ext}))
+		return err
+	}
+
+	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+}
+
+// Ends a dispute as decided by the arbiter, whose signature has been verified already.
+// The seller receives sellerShare of the price, the buyer gets back the rest.
+func SettleDispute(c context.Context, txKey *datastore.Key, now time.Time,
+	sellerShare money.Money, document, signature string) error {
+
+	var retired *Transaction
+	f := func(c context.Context) error {
+		retired = nil
+		tx, ext, err := GetTransaction(c, txKey)
+		if err != nil {
+			return err
+		}
+
+		if ext.Dispute != DisputeOpen {
+			return &ConflictError{"Transaction is not disputed"}
+		} else if sellerShare.Currency != tx.Price.Currency {
+			return fmt.Errorf("Seller's share must be given in %v", tx.Price.Currency)
+		}
+
+		// The arbiter is neither buyer nor seller, and is recorded with the transaction
+		ext.Arbiter = config.CfgArbiterAccount
+		message := Tmessage{
+			Received:  now,
+			From:      FromUnknown,
+			Document:  document,
+			Signature: signature,
+			Accepted:  true,
+			PrePhase:  tx.Phase,
+			PostPhase: tx.Phase,
+		}
+		if err := settleDispute(c, txKey, tx, ext, now, sellerShare, &message); err != nil {
+			return err
+		}
+		retired = tx
+		return nil
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	countRetiredTransaction(retired)
+	return nil
+}
+
+// Settles a dispute the arbiter hasn't settled before its deadline. If delivery has
+// been proven, the seller receives the whole price, as the buyer holds the result.
+// Otherwise, the buyer is refunded. Does nothing if the dispute has been settled.
+func SettleOverdueDispute(c context.Context, txKey *datastore.Key, now time.Time) error {
+	var retired *Transaction
+	f := func(c context.Context) error {
+		retired = nil
+		tx, ext, err := GetTransaction(c, txKey)
+		if err != nil {
+			return err
+		}
+
+		if ext.Dispute != DisputeOpen {
+			return nil
+		} else if deadline := disputeDeadline(ext); now.Before(deadline) {
+			return fmt.Errorf("Dispute of transaction %v is due at %v", txKey, deadline)
+		}
+
+		sellerShare := money.Money{Currency: tx.Price.Currency}
+		if deliveryProven(tx) {
+			sellerShare = tx.Price
+		}
+
+		// Unsigned, as it is sent by the server itself
+		message := Tmessage{
+			Received:  now,
+			From:      FromUnknown,
+			Document:  "sellershare=" + url.QueryEscape(sellerShare.String()),
+			Accepted:  true,
+			PrePhase:  tx.Phase,
+			PostPhase: tx.Phase,
+		}
+		if err := settleDispute(c, txKey, tx, ext, now, sellerShare, &message); err != nil {
+			return err
+		}
+		retired = tx
+		return nil
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	countRetiredTransaction(retired)
+	return nil
+}
+
+// Retires a disputed transaction, booking sellerShare of the price to the seller,
+// and stores the settling message. Must be called inside a transaction.
+func settleDispute(c context.Context, txKey *datastore.Key, tx *Transaction, ext *TxExtension,
+	now time.Time, sellerShare money.Money, message *Tmessage) error {
+
+	dao := NewGaeAccountingDao(c, true)
+	if fee, err := settleTransaction(dao, txKey.Encode(), tx, sellerShare, now); err != nil {
+		return err
+	} else if err := chargeFee(c, txKey.Encode(), tx, ext, fee); err != nil {
+		return err
+	} else if err := addAggregatePriceTask(c, txKey.Encode(), tx); err != nil {
+		return err
+	}
+	ext.Dispute = DisputeSettled
+	ext.SellerShare = sellerShare
+	ext.Retired = now
+	tx.Revision++
+
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tmessage", txKey), message); err != nil {
+		return err
+	}
+
+	if _, err := datastore.Put(c, txKey, datastore.PropertyLoadSaver(txCodec{tx, ext})); err != nil {
+		return err
+	}
+
+	return dao.Flush()
+}
@@ -0,0 +1,302 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"google.golang.org/appengine/datastore"
+)
+
+// The entity kinds that make up the server's state, in the order they are exported.
+var ExportKinds = []string{
+	"Account", "AccountMovement", "Deposit", "Team",
+	"Bid", "BidRequest", "HotBid", "Tx", "Tmessage",
+	"Nonce", "Motd", "Halt", "Suspension", "AuditEntry", "SuspiciousPair", "SuspicionScan",
+	"ArchivedTx", "ArchiveState", "PriceSlot",
+}
+
+// Entities of these kinds are exported and imported through their codecs, so that
+// they are validated on the way.
+var exportCodecs = map[string]func(c context.Context) datastore.PropertyLoadSaver{
+	"Account":         func(c context.Context) datastore.PropertyLoadSaver { return accountCodec{new(ParticipantAccount)} },
+	"AccountMovement": func(c context.Context) datastore.PropertyLoadSaver { return movementCodec{c, new(AccountMovement)} },
+	"Deposit":         func(c context.Context) datastore.PropertyLoadSaver { return depositCodec{new(Deposit)} },
+	"Team":            func(c context.Context) datastore.PropertyLoadSaver { return teamCodec{new(Team)} },
+	"Bid":             func(c context.Context) datastore.PropertyLoadSaver { return bidCodec{new(Bid), new(BidExtension)} },
+	"HotBid":          func(c context.Context) datastore.PropertyLoadSaver { return hotBidCodec{new(hotBid)} },
+	"Tx": func(c context.Context) datastore.PropertyLoadSaver {
+		return txCodec{new(Transaction), new(TxExtension)}
+	},
+}
+
+func newExportEntity(c context.Context, kind string) datastore.PropertyLoadSaver {
+	if f, ok := exportCodecs[kind]; ok {
+		return f(c)
+	}
+	return &datastore.PropertyList{}
+}
+
+// One entity as written to a line of a JSON Lines export. Keys are written as paths,
+// so they don't depend on the application they were exported from.
+type ExportRecord struct {
+	Key        []ExportKeyElement `json:"key"`
+	Properties []ExportProperty   `json:"properties"`
+}
+
+type ExportKeyElement struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+	ID   int64  `json:"id,omitempty"`
+}
+
+// A property and its type, which is one of "string", "int", "bool", "float", "time"
+// (RFC 3339), "key" (a path), "blob" or "bytestring" (both base64) and "null".
+type ExportProperty struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value"`
+	NoIndex  bool        `json:"noindex,omitempty"`
+	Multiple bool        `json:"multiple,omitempty"`
+}
+
+// Maximum number of entities exported per call of ExportEntities
+const MaxExportBatchSize = 1000
+
+// Exports up to limit entities of a kind, starting at the given cursor, by passing
+// them to the handler. Returns the cursor where to continue, or the empty string if
+// all entities have been exported.
+func ExportEntities(c context.Context, kind, cursor string, limit int, handler func(*ExportRecord) error) (string, error) {
+	if !isExportKind(kind) {
+		return "", fmt.Errorf("Unknown kind: %#v", kind)
+	}
+	if limit <= 0 || limit > MaxExportBatchSize {
+		limit = MaxExportBatchSize
+	}
+
+	query := datastore.NewQuery(kind).Order("__key__")
+	if cursor != "" {
+		if cur, err := datastore.DecodeCursor(cursor); err != nil {
+			return "", err
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	for count := 0; count < limit; count++ {
+		entity := newExportEntity(c, kind)
+		key, err := iter.Next(entity)
+		if err == datastore.Done {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("Error loading %v: %v", key, err)
+		}
+
+		props, err := entity.Save()
+		if err != nil {
+			return "", err
+		}
+		record := ExportRecord{Key: exportKey(key), Properties: make([]ExportProperty, 0, len(props))}
+		for _, p := range props {
+			if prop, err := exportProperty(p); err != nil {
+				return "", fmt.Errorf("Error exporting %v: %v", key, err)
+			} else {
+				record.Properties = append(record.Properties, prop)
+			}
+		}
+		if err := handler(&record); err != nil {
+			return "", err
+		}
+	}
+
+	if cur, err := iter.Cursor(); err != nil {
+		return "", err
+	} else {
+		return cur.String(), nil
+	}
+}
+
+// Writes the given records to the datastore, replacing existing entities with the
+// same keys. Keys are created in the importing application. Records must have been
+// decoded using json.Decoder.UseNumber, so that numbers keep their precision.
+func ImportEntities(c context.Context, records []ExportRecord) error {
+	keys := make([]*datastore.Key, len(records))
+	entities := make([]datastore.PropertyLoadSaver, len(records))
+	for i := range records {
+		record := &records[i]
+		key, err := importKey(c, record.Key)
+		if err != nil {
+			return fmt.Errorf("Record #%v: %v", i, err)
+		} else if !isExportKind(key.Kind()) {
+			return fmt.Errorf("Record #%v: Unknown kind: %#v", i, key.Kind())
+		}
+
+		props := make([]datastore.Property, len(record.Properties))
+		for j, prop := range record.Properties {
+			if p, err := importProperty(c, prop); err != nil {
+				return fmt.Errorf("Record #%v: %v", i, err)
+			} else {
+				props[j] = p
+			}
+		}
+
+		entity := newExportEntity(c, key.Kind())
+		if err := entity.Load(props); err != nil {
+			return fmt.Errorf("Record #%v: Error loading %v: %v", i, key, err)
+		}
+		keys[i], entities[i] = key, entity
+	}
+
+	_, err := datastore.PutMulti(c, keys, entities)
+	return err
+}
+
+func isExportKind(kind string) bool {
+	for _, k := range ExportKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func exportKey(key *datastore.Key) []ExportKeyElement {
+	if key == nil {
+		return nil
+	}
+	path := exportKey(key.Parent())
+	return append(path, ExportKeyElement{Kind: key.Kind(), Name: key.StringID(), ID: key.IntID()})
+}
+
+func importKey(c context.Context, path []ExportKeyElement) (*datastore.Key, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Empty key")
+	}
+	var key *datastore.Key
+	for _, e := range path {
+		if e.Kind == "" || (e.Name == "") == (e.ID == 0) {
+			return nil, fmt.Errorf("Invalid key element: %+v", e)
+		}
+		key = datastore.NewKey(c, e.Kind, e.Name, e.ID, key)
+	}
+	return key, nil
+}
+
+func exportProperty(p datastore.Property) (ExportProperty, error) {
+	prop := ExportProperty{Name: p.Name, NoIndex: p.NoIndex, Multiple: p.Multiple}
+	switch v := p.Value.(type) {
+	case nil:
+		prop.Type = "null"
+	case string:
+		prop.Type, prop.Value = "string", v
+	case int64:
+		// Written as a string, as JSON numbers can't hold all int64 values precisely
+		prop.Type, prop.Value = "int", fmt.Sprint(v)
+	case bool:
+		prop.Type, prop.Value = "bool", v
+	case float64:
+		prop.Type, prop.Value = "float", v
+	case time.Time:
+		prop.Type, prop.Value = "time", v.UTC().Format(time.RFC3339Nano)
+	case *datastore.Key:
+		if v == nil {
+			prop.Type = "null"
+		} else {
+			prop.Type, prop.Value = "key", exportKey(v)
+		}
+	case []byte:
+		prop.Type, prop.Value = "blob", base64.StdEncoding.EncodeToString(v)
+	case datastore.ByteString:
+		prop.Type, prop.Value = "bytestring", base64.StdEncoding.EncodeToString(v)
+	default:
+		return prop, fmt.Errorf("Property %v has unsupported type %T", p.Name, p.Value)
+	}
+	return prop, nil
+}
+
+func importProperty(c context.Context, prop ExportProperty) (datastore.Property, error) {
+	p := datastore.Property{Name: prop.Name, NoIndex: prop.NoIndex, Multiple: prop.Multiple}
+	invalid := fmt.Errorf("Property %v: invalid value for type %v: %v", prop.Name, prop.Type, prop.Value)
+	var err error
+	switch prop.Type {
+	case "null":
+	case "string":
+		if s, ok := prop.Value.(string); ok {
+			p.Value = s
+		} else {
+			return p, invalid
+		}
+	case "int":
+		var n int64
+		if s, ok := prop.Value.(string); !ok {
+			return p, invalid
+		} else if _, err := fmt.Sscan(s, &n); err != nil {
+			return p, invalid
+		}
+		p.Value = n
+	case "bool":
+		if b, ok := prop.Value.(bool); ok {
+			p.Value = b
+		} else {
+			return p, invalid
+		}
+	case "float":
+		if n, ok := prop.Value.(json.Number); !ok {
+			return p, invalid
+		} else if p.Value, err = n.Float64(); err != nil {
+			return p, invalid
+		}
+	case "time":
+		if s, ok := prop.Value.(string); !ok {
+			return p, invalid
+		} else if p.Value, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return p, invalid
+		}
+	case "key":
+		var path []ExportKeyElement
+		if b, err := json.Marshal(prop.Value); err != nil {
+			return p, invalid
+		} else if err := json.Unmarshal(b, &path); err != nil {
+			return p, invalid
+		} else if p.Value, err = importKey(c, path); err != nil {
+			return p, fmt.Errorf("Property %v: %v", prop.Name, err)
+		}
+	case "blob", "bytestring":
+		s, ok := prop.Value.(string)
+		if !ok {
+			return p, invalid
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return p, invalid
+		}
+		if prop.Type == "blob" {
+			p.Value = b
+		} else {
+			p.Value = datastore.ByteString(b)
+		}
+	default:
+		return p, fmt.Errorf("Property %v has unknown type %#v", prop.Name, prop.Type)
+	}
+	return p, nil
+}
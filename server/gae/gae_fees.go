@@ -0,0 +1,119 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// A FeeRole tells which fee a transaction's buyer pays.
+type FeeRole string
+
+const (
+	FeeRoleMaker FeeRole = "maker" // The buyer's bid rested in the book
+	FeeRoleTaker FeeRole = "taker" // The buyer's bid was matched on arrival
+)
+
+// Fees are given in basis points, i.e. hundredths of a percent
+const basisPoints = 10000
+
+// Function applyFeeRule sets the fee of a freshly created transaction, whose price
+// has already been decided. The whole fee is paid by the buyer, as only buy bids
+// block a fee: at the taker rate if the buyer's bid was the incoming one, at the
+// maker rate if it rested in the book. Sellers pay no fee in either role. The fee
+// never exceeds the fee blocked for the buyer's bid.
+func applyFeeRule(tx *Transaction, ext *TxExtension, incoming, resting *Bid) {
+	settings := config.GetArticleSettings(string(tx.Article))
+	buyerBid, rate := incoming, settings.TakerFeeBasisPoints
+	ext.FeeRole = FeeRoleTaker
+	if incoming.Type != Buy {
+		buyerBid, rate = resting, settings.MakerFeeBasisPoints
+		ext.FeeRole = FeeRoleMaker
+	}
+
+	tx.Fee.Amount = scaleAmount(tx.Price.Amount, rate, basisPoints)
+	if tx.Fee.Amount > buyerBid.Fee.Amount {
+		tx.Fee.Amount = buyerBid.Fee.Amount
+	}
+}
+
+// Returns the fee charged when the transaction was retired. Transactions retired
+// before charged fees were recorded paid their full fee if they were successful, and
+// nothing otherwise.
+func ChargedFee(tx *Transaction, ext *TxExtension) money.Money {
+	if tx.State != StateRetired || ext.ChargedFee.Amount != 0 || ext.FeeRole != "" || ext.Dispute == DisputeSettled {
+		return ext.ChargedFee
+	} else if tx.Phase == PhaseUnverified || tx.Phase == PhaseFinished {
+		return tx.Fee
+	}
+	return money.Money{Currency: tx.Fee.Currency}
+}
+
+// Records the fee charged when retiring a transaction and schedules crediting it
+// to the fee account. Must be called inside the retiring datastore transaction.
+func chargeFee(c context.Context, txKey string, tx *Transaction, ext *TxExtension, fee money.Money) error {
+	ext.ChargedFee = fee
+	if fee.Amount == 0 {
+		return nil
+	}
+	return addCollectFeeTask(c, txKey, tx)
+}
+
+// Credits the fee charged on a retired transaction to the fee account, unless this
+// has been done before. The fee account's ledger shows a movement per transaction.
+func CollectFee(c context.Context, key *datastore.Key) error {
+	f := func(c context.Context) error {
+		tx, ext, err := GetTransaction(c, key)
+		if err != nil {
+			return err
+		}
+
+		if ext.FeeCollected || ext.ChargedFee.Amount == 0 {
+			log.Infof(c, "No fee to collect for transaction %v", key)
+			return nil
+		}
+
+		// The fee left the system when the transaction was retired. Crediting it to the
+		// fee account brings it back in, which the ledger knows as a pay-in.
+		txKey := key.Encode()
+		dao := NewGaeAccountingDao(c, true)
+		zero := money.Money{Currency: ext.ChargedFee.Currency}
+		if err := PlaceAccountMovement(dao, time.Now(), AccountMovementPayIn,
+			config.CfgFeeAccount, config.CfgFeeAccount,
+			ext.ChargedFee, zero,
+			zero, ext.ChargedFee.Neg(),
+			nil, &txKey, nil, nil); err != nil {
+			return err
+		}
+
+		ext.FeeCollected = true
+		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(txCodec{tx, ext})); err != nil {
+			return err
+		}
+
+		return dao.Flush()
+	}
+
+	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+}
@@ -0,0 +1,60 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"testing"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+)
+
+func TestApplyFeeRule(t *testing.T) {
+	config.CfgArticleSettings["test-fees"] = config.ArticleSettings{
+		PriceRule:           "resting",
+		MakerFeeBasisPoints: 100,
+		TakerFeeBasisPoints: 300,
+	}
+	defer delete(config.CfgArticleSettings, "test-fees")
+
+	btc := func(amount int64) money.Money { return money.Money{Currency: money.BTC, Amount: amount} }
+	bid := func(bidType BidType, fee int64) *Bid {
+		return &Bid{Type: bidType, Price: btc(10000), Fee: btc(fee)}
+	}
+
+	for _, c := range []struct {
+		name              string
+		price             int64
+		incoming, resting *Bid
+		role              FeeRole
+		fee               int64
+	}{
+		{"incoming buy pays the taker fee", 10000, bid(Buy, 300), bid(Sell, 0), FeeRoleTaker, 300},
+		{"resting buy pays the maker fee", 10000, bid(Sell, 0), bid(Buy, 300), FeeRoleMaker, 100},
+		{"fee is capped by the buy bid's fee", 10000, bid(Buy, 200), bid(Sell, 0), FeeRoleTaker, 200},
+		{"fee is rounded down", 50, bid(Buy, 300), bid(Sell, 0), FeeRoleTaker, 1},
+		{"fee may be zero", 10, bid(Sell, 0), bid(Buy, 300), FeeRoleMaker, 0},
+	} {
+		tx := &Transaction{Article: "test-fees", Price: btc(c.price), Fee: btc(12345)}
+		var ext TxExtension
+		applyFeeRule(tx, &ext, c.incoming, c.resting)
+		if ext.FeeRole != c.role || tx.Fee.Amount != c.fee {
+			t.Errorf("%v: Expected role %v and fee %v, got %v and %v", c.name, c.role, c.fee, ext.FeeRole, tx.Fee.Amount)
+		}
+	}
+}
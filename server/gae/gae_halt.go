@@ -0,0 +1,152 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// The scope of a halt covering the whole market, i.e. maintenance mode
+const MaintenanceScope = "*"
+
+// Maximum number of halts considered
+const maxHalts = 100
+
+// A halt of trading, as ordered by the admin. While a halt is in force, no new bids
+// are accepted and incoming bids aren't matched. Transactions continue.
+type Halt struct {
+	Scope     string    `datastore:"-"` // The article halted, or MaintenanceScope
+	Reason    string    `datastore:",noindex"`
+	Since     time.Time `datastore:",noindex"`
+	Document  string    `datastore:",noindex"`
+	Signature string    `datastore:",noindex"`
+	// Matching that was skipped because of the halt
+	Paused []PausedMatching
+}
+
+// Identifies bids waiting to be matched
+type PausedMatching struct {
+	Article  string `datastore:",noindex"`
+	MatchKey string `datastore:",noindex"`
+}
+
+func HaltKey(c context.Context, scope string) *datastore.Key {
+	return datastore.NewKey(c, "Halt", scope, 0, nil)
+}
+
+// Returns whether the halt covers the whole market.
+func (h *Halt) IsMaintenance() bool {
+	return h.Scope == MaintenanceScope
+}
+
+// Puts a halt into force, or changes the reason of a halt already in force.
+func SetHalt(c context.Context, halt *Halt) error {
+	f := func(c context.Context) error {
+		key := HaltKey(c, halt.Scope)
+		var existing Halt
+		if err := datastore.Get(c, key, &existing); err == nil {
+			halt.Since = existing.Since
+			halt.Paused = existing.Paused
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := datastore.Put(c, key, halt)
+		return err
+	}
+	return datastore.RunInTransaction(c, f, nil)
+}
+
+// Lifts a halt. Returns the matching that was skipped while the halt was in force,
+// so it can be triggered again. Lifting a halt not in force is not an error.
+func LiftHalt(c context.Context, scope string) ([]PausedMatching, error) {
+	var paused []PausedMatching
+	f := func(c context.Context) error {
+		paused = nil
+		key := HaltKey(c, scope)
+		var halt Halt
+		if err := datastore.Get(c, key, &halt); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		paused = halt.Paused
+		return datastore.Delete(c, key)
+	}
+	if err := datastore.RunInTransaction(c, f, nil); err != nil {
+		return nil, err
+	}
+	return paused, nil
+}
+
+// Returns the halt in force for an article, or nil if trading is allowed.
+// Maintenance mode takes precedence over a halt of the article.
+func GetHalt(c context.Context, article string) (*Halt, error) {
+	for _, scope := range []string{MaintenanceScope, article} {
+		var halt Halt
+		if err := datastore.Get(c, HaltKey(c, scope), &halt); err == nil {
+			halt.Scope = scope
+			return &halt, nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Returns all halts in force.
+func QueryHalts(c context.Context) ([]Halt, error) {
+	halts := make([]Halt, 0, 4)
+	keys, err := datastore.NewQuery("Halt").Limit(maxHalts).GetAll(c, &halts)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		halts[i].Scope = key.StringID()
+	}
+	return halts, nil
+}
+
+// Records that matching was skipped for a match key because of a halt.
+func pauseMatching(c context.Context, halt *Halt, article, matchKey string) error {
+	f := func(c context.Context) error {
+		key := HaltKey(c, halt.Scope)
+		var current Halt
+		if err := datastore.Get(c, key, &current); err == datastore.ErrNoSuchEntity {
+			// Lifted in the meantime
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, paused := range current.Paused {
+			if paused.MatchKey == matchKey {
+				return nil
+			}
+		}
+		current.Paused = append(current.Paused, PausedMatching{article, matchKey})
+		_, err := datastore.Put(c, key, &current)
+		return err
+	}
+	if err := datastore.RunInTransaction(c, f, nil); err != nil {
+		return err
+	}
+	log.Infof(c, "Matching paused for %v: %v", matchKey, halt.Reason)
+	return nil
+}
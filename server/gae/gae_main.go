@@ -23,6 +23,8 @@ import (
 	"time"
 
 	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk/server/config"
+	"github.com/indyjo/bitwrk/server/metrics"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
@@ -46,74 +48,166 @@ func DepositUid(key *datastore.Key) string {
 	return key.StringID()
 }
 
-func GetBid(c context.Context, bidId string) (bid *Bid, err error) {
+func GetBid(c context.Context, bidId string) (bid *Bid, ext *BidExtension, err error) {
 	key, err := datastore.DecodeKey(bidId)
 	if err != nil {
 		return
 	}
 	bid = new(Bid)
-	err = datastore.Get(c, key, bidCodec{bid})
+	ext = new(BidExtension)
+	err = datastore.Get(c, key, bidCodec{bid, ext})
 	return
 }
 
 var ErrTransactionTooYoung = fmt.Errorf("Transaction is too young to be retired")
 var ErrTransactionAlreadyRetired = fmt.Errorf("Transaction has already been retired")
+var ErrTransactionTooOld = fmt.Errorf("Transaction has timed out already")
 
-// Transactional function to enqueue a bid, while keeping accounts in balance
-func EnqueueBid(c context.Context, bid *Bid) (*datastore.Key, error) {
-	var bidKey *datastore.Key
+// Returned by EnqueueBid if the participant's balance, or a team member's spending
+// limit, doesn't cover the bid.
+type InsufficientFundsError struct {
+	Reason error
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return e.Reason.Error()
+}
+
+// Returned if a request is valid in itself, but doesn't fit the current state of the
+// transaction it refers to.
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// Returned if the sender of a request isn't allowed to perform it.
+type PermissionError struct {
+	Message string
+}
+
+func (e *PermissionError) Error() string {
+	return e.Message
+}
+
+// Maps a client-supplied request ID to the bid created for it, for as long as the
+// bid lives.
+type bidRequest struct {
+	Bid     *datastore.Key
+	Expires time.Time
+}
+
+// Request IDs are unique per address that signed the bid.
+func bidRequestKey(c context.Context, bid *Bid, ext *BidExtension) *datastore.Key {
+	signer := bid.Participant
+	if ext.Signer != "" {
+		signer = ext.Signer
+	}
+	return datastore.NewKey(c, "BidRequest", signer+"/"+ext.RequestId, 0, nil)
+}
+
+// Transactional function to enqueue a bid, while keeping accounts in balance.
+// If the bid carries a request ID that has been used for a bid still alive, nothing
+// is enqueued. Instead, the existing bid's key is returned and created is false.
+func EnqueueBid(c context.Context, bid *Bid, ext *BidExtension) (bidKey *datastore.Key, created bool, err error) {
 	f := func(c context.Context) error {
 		dao := NewGaeAccountingDao(c, true)
-
-		if err := bid.CheckBalance(dao); err != nil {
+		if bidKey, created, err = enqueueBid(c, dao, bid, ext); err != nil {
 			return err
 		}
+		return dao.Flush()
+	}
 
-		//parentKey := ArticleKey(c, bid.Article)
-		//parentKey := AccountKey(c, bid.Participant)
-		if key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Bid", nil),
-			datastore.PropertyLoadSaver(bidCodec{bid})); err != nil {
-			return err
-		} else {
-			bidKey = key
-		}
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return nil, false, err
+	}
 
-		if err := bid.Book(dao, bidKey.Encode()); err != nil {
-			return err
-		}
+	if created {
+		metrics.BidsEnqueued.Inc(string(bid.Article), bid.Type.String())
+	}
+	return bidKey, created, nil
+}
 
-		if err := addRetireBidTask(c, bidKey.Encode(), bid); err != nil {
-			return err
+// Books a bid and schedules it for matching. Must be called inside a transaction,
+// which must flush dao afterwards.
+func enqueueBid(c context.Context, dao CachedAccountingDao, bid *Bid, ext *BidExtension) (*datastore.Key, bool, error) {
+	if ext.RequestId != "" {
+		var request bidRequest
+		if err := datastore.Get(c, bidRequestKey(c, bid, ext), &request); err == nil {
+			if request.Expires.After(time.Now()) {
+				return request.Bid, false, nil
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return nil, false, err
 		}
+	}
 
-		// Encode the new bid as a hotBid and put it into a pull queue
-		hot := newHotBid(bidKey, bid)
-		if bytes, err := json.Marshal(*hot); err != nil {
-			return err
-		} else {
-			var task taskqueue.Task
-			task.Method = "PULL"
-			task.Payload = bytes
-			task.Tag = bid.MatchKey()
-			if _, err := taskqueue.Add(c, &task, "hotbids"); err != nil {
-				return err
-			}
+	if err := bid.CheckBalance(dao); err != nil {
+		return nil, false, &InsufficientFundsError{err}
+	}
+
+	// Bids placed by team members must also stay within the member's limits
+	if ext.Signer != "" {
+		if err := chargeTeamMember(c, bid, ext.Signer, time.Now()); err != nil {
+			return nil, false, err
 		}
+	}
 
-		return dao.Flush()
+	//parentKey := ArticleKey(c, bid.Article)
+	//parentKey := AccountKey(c, bid.Participant)
+	var bidKey *datastore.Key
+	if key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Bid", nil),
+		datastore.PropertyLoadSaver(bidCodec{bid, ext})); err != nil {
+		return nil, false, err
+	} else {
+		bidKey = key
 	}
 
-	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
-		return nil, err
+	if err := bid.Book(dao, bidKey.Encode()); err != nil {
+		return nil, false, err
+	}
+
+	if err := addRetireBidTask(c, bidKey.Encode(), bid); err != nil {
+		return nil, false, err
+	}
+
+	if ext.RequestId != "" {
+		request := bidRequest{bidKey, bid.Expires}
+		if _, err := datastore.Put(c, bidRequestKey(c, bid, ext), &request); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Encode the new bid as a hotBid and put it into a pull queue
+	hot := newHotBid(bidKey, bid, ext)
+	if bytes, err := json.Marshal(*hot); err != nil {
+		return nil, false, err
+	} else {
+		var task taskqueue.Task
+		task.Method = "PULL"
+		task.Payload = bytes
+		task.Tag = bid.MatchKey()
+		if _, err := taskqueue.Add(c, &task, "hotbids"); err != nil {
+			return nil, false, err
+		}
 	}
 
-	return bidKey, nil
+	return bidKey, true, nil
 }
 
 // Function TriggerBatchProcessing performs the actual matching process specific to a matchKey.
 // A semaphore placed in memcache ensures that only one matching process is active at any time,
-// per matchKey.
-func TriggerBatchProcessing(c context.Context, matchKey string) error {
+// per matchKey. While trading in the article is halted, matching is skipped and
+// remembered, to be triggered again when the halt is lifted.
+func TriggerBatchProcessing(c context.Context, article ArticleId, matchKey string) error {
+	if halt, err := GetHalt(c, string(article)); err != nil {
+		return err
+	} else if halt != nil {
+		return pauseMatching(c, halt, string(article), matchKey)
+	}
+
 	// Instead of submitting a task to match incoming bids, resulting in one task per bid,
 	// we collect bids for up to two seconds and batch-process them afterwards.
 	semaphoreKey := "semaphore-" + matchKey
@@ -132,6 +226,7 @@ func TriggerBatchProcessing(c context.Context, matchKey string) error {
 		matchingErr := MatchIncomingBids(c, matchKey)
 		time_after := time.Now()
 		duration := time_after.Sub(time_before)
+		metrics.MatchingDuration.Observe(duration.Seconds(), matchKey)
 		if duration > 1000*time.Millisecond {
 			log.Errorf(c, "Batch processing finished after %v. Limit exceeded!", duration)
 		} else if duration > 500*time.Millisecond {
@@ -145,27 +240,36 @@ func TriggerBatchProcessing(c context.Context, matchKey string) error {
 
 // This will reimburse the bid's price and fee to the buyer.
 func RetireBid(c context.Context, key *datastore.Key) error {
+	// Set if the bid expired without being matched
+	var expired *Bid
 	f := func(c context.Context) error {
+		expired = nil
 		now := time.Now()
 		dao := NewGaeAccountingDao(c, true)
 		var bid Bid
-		if err := datastore.Get(c, key, bidCodec{&bid}); err != nil {
+		var ext BidExtension
+		if err := datastore.Get(c, key, bidCodec{&bid, &ext}); err != nil {
+			return err
+		}
+
+		// The bid's request ID may be used again from now on
+		if err := releaseBidRequest(c, key, &bid, &ext); err != nil {
 			return err
 		}
 
 		if bid.State == Matched {
 			log.Infof(c, "Not retiring matched bid %v", key)
 			return nil
+		} else if bid.State == Expired {
+			log.Infof(c, "Bid %v has been retired already", key)
+			return nil
 		}
 
-		if err := bid.Retire(dao, key.Encode(), now); err != nil {
-			return err
-		}
-
-		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(bidCodec{&bid})); err != nil {
+		if err := retireBid(c, dao, key, &bid, &ext, now); err != nil {
 			return err
 		}
 
+		expired = &bid
 		return dao.Flush()
 	}
 
@@ -173,9 +277,44 @@ func RetireBid(c context.Context, key *datastore.Key) error {
 		return err
 	}
 
+	if expired != nil {
+		metrics.BidsExpired.Inc(string(expired.Article))
+	}
+	return nil
+}
+
+// Makes the bid's request ID usable again. Must be called inside a transaction.
+func releaseBidRequest(c context.Context, key *datastore.Key, bid *Bid, ext *BidExtension) error {
+	if ext.RequestId == "" {
+		return nil
+	}
+	requestKey := bidRequestKey(c, bid, ext)
+	var request bidRequest
+	if err := datastore.Get(c, requestKey, &request); err == nil && request.Bid.Equal(key) {
+		return datastore.Delete(c, requestKey)
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
 	return nil
 }
 
+// Retires an unmatched bid, reimbursing what has been blocked for it, and stores it.
+// Must be called inside a transaction.
+func retireBid(c context.Context, dao AccountingDao, key *datastore.Key, bid *Bid, ext *BidExtension, now time.Time) error {
+	if err := bid.Retire(dao, key.Encode(), now); err != nil {
+		return err
+	}
+
+	if ext.Signer != "" {
+		if err := refundTeamMember(c, bid, ext.Signer, bidSpend(bid)); err != nil {
+			return err
+		}
+	}
+
+	_, err := datastore.Put(c, key, datastore.PropertyLoadSaver(bidCodec{bid, ext}))
+	return err
+}
+
 // Marks a bid as placed. This is purely informational for the user.
 func PlaceBid(c context.Context, bidId string) error {
 	var key *datastore.Key
@@ -187,7 +326,8 @@ func PlaceBid(c context.Context, bidId string) error {
 
 	f := func(c context.Context) error {
 		var bid Bid
-		if err := datastore.Get(c, key, datastore.PropertyLoadSaver(bidCodec{&bid})); err != nil {
+		var ext BidExtension
+		if err := datastore.Get(c, key, datastore.PropertyLoadSaver(bidCodec{&bid, &ext})); err != nil {
 			return err
 		}
 
@@ -198,7 +338,7 @@ func PlaceBid(c context.Context, bidId string) error {
 
 		bid.State = Placed
 
-		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(bidCodec{&bid})); err != nil {
+		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(bidCodec{&bid, &ext})); err != nil {
 			return err
 		}
 		return nil
@@ -208,21 +348,33 @@ func PlaceBid(c context.Context, bidId string) error {
 }
 
 // Transactions in phase FINISHED will cause the price to be credited on the seller's
-// account, and the fee to be deducted.
+// account, and the fee to be deducted and passed on to the fee account.
 // All other phases will lead to price and fee being reimbursed to the buyer.
 // Returns ErrTransactionTooYoung if the transaction has not passed its timout at the
 // time of the call.
 // Returns ErrTransactionAlreadyRetired if the transaction has already been retired at
 // the time of the call.
+// Returns ErrTransactionDisputed if the transaction is waiting for the arbiter.
 func RetireTransaction(c context.Context, key *datastore.Key) error {
+	var retired *Transaction
 	f := func(c context.Context) error {
+		retired = nil
 		now := time.Now()
 		dao := NewGaeAccountingDao(c, true)
 		var tx Transaction
-		if err := datastore.Get(c, key, txCodec{&tx}); err != nil {
+		var ext TxExtension
+		if err := datastore.Get(c, key, txCodec{&tx, &ext}); err != nil {
 			return err
 		}
 
+		// Disputed transactions wait for the arbiter
+		if ext.Dispute == DisputeOpen {
+			return ErrTransactionDisputed
+		}
+
+		// Only successful transactions are charged a fee
+		successful := tx.Phase == PhaseUnverified || tx.Phase == PhaseFinished
+
 		if err := tx.Retire(dao, key.Encode(), now); err == ErrTooYoung {
 			return ErrTransactionTooYoung
 		} else if err == ErrAlreadyRetired {
@@ -231,23 +383,59 @@ func RetireTransaction(c context.Context, key *datastore.Key) error {
 			return err
 		}
 
-		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(txCodec{&tx})); err != nil {
+		if successful {
+			if err := chargeFee(c, key.Encode(), &tx, &ext, tx.Fee); err != nil {
+				return err
+			}
+		}
+		ext.Retired = now
+		if err := addAggregatePriceTask(c, key.Encode(), &tx); err != nil {
+			return err
+		}
+
+		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(txCodec{&tx, &ext})); err != nil {
 			return err
 		}
 
+		retired = &tx
 		return dao.Flush()
 	}
 
-	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	}
+
+	countRetiredTransaction(retired)
+	return nil
 }
 
-func GetTransaction(c context.Context, key *datastore.Key) (*Transaction, error) {
+// Updates the metrics after a transaction has been retired successfully.
+func countRetiredTransaction(tx *Transaction) {
+	if tx != nil {
+		metrics.TransactionsRetired.Inc(string(tx.Article), tx.Phase.String())
+	}
+}
+
+// Returns the transaction with the given key, along with its server-side extension.
+// Transactions that have been archived are restored from their archive record, as far
+// as it has been kept. Such transactions are read-only, see TxExtension.Archived.
+func GetTransaction(c context.Context, key *datastore.Key) (*Transaction, *TxExtension, error) {
 	var tx Transaction
-	if err := datastore.Get(c, key, txCodec{&tx}); err != nil {
-		return nil, err
+	var ext TxExtension
+	if err := datastore.Get(c, key, txCodec{&tx, &ext}); err == datastore.ErrNoSuchEntity {
+		var archived ArchivedTx
+		if err := datastore.Get(c, archivedTxKey(c, key), &archived); err == datastore.ErrNoSuchEntity {
+			return nil, nil, datastore.ErrNoSuchEntity
+		} else if err != nil {
+			return nil, nil, err
+		}
+		archivedTx, archivedExt := archived.transaction()
+		return archivedTx, archivedExt, nil
+	} else if err != nil {
+		return nil, nil, err
 	}
 
-	return &tx, nil
+	return &tx, &ext, nil
 }
 
 func GetTransactionMessages(c context.Context, key *datastore.Key) ([]Tmessage, error) {
@@ -260,6 +448,28 @@ func GetTransactionMessages(c context.Context, key *datastore.Key) ([]Tmessage,
 	return messages, nil
 }
 
+// Maximum number of messages stored per transaction before rejected messages are
+// no longer stored. Accepted messages are always stored.
+const maxStoredMessages = 50
+
+// Stores a rejected message in the transaction's history, if it was sent by one of
+// the transaction's participants or the arbiter, and the history isn't full yet.
+// Messages from anyone else would let them grow the public history of any transaction.
+// Must be called inside a transaction.
+func storeRejectedMessage(c context.Context, txKey *datastore.Key, tx *Transaction, sender string, message *Tmessage) error {
+	if sender != tx.Buyer && sender != tx.Seller && sender != config.CfgArbiterAccount {
+		return nil
+	}
+	if count, err := datastore.NewQuery("Tmessage").Ancestor(txKey).KeysOnly().
+		Limit(maxStoredMessages).Count(c); err != nil {
+		return err
+	} else if count >= maxStoredMessages {
+		return nil
+	}
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tmessage", txKey), message)
+	return err
+}
+
 // Sends a message (defined by its argument values) to the transaction and performs
 // the corresponding changes atomically.
 // Returns the updated transaction on success.
@@ -269,33 +479,70 @@ func UpdateTransaction(c context.Context, txKey *datastore.Key,
 	values map[string]string,
 	document, signature string) error {
 
+	// Rejected messages are stored, too, but leave the transaction untouched
+	var rejected *Tmessage
+
 	f := func(c context.Context) error {
-		tx, err := GetTransaction(c, txKey)
+		rejected = nil
+		tx, ext, err := GetTransaction(c, txKey)
 		if err != nil {
 			return err
 		}
 
-		message := tx.SendMessage(now, address, values)
+		if ext.Archived {
+			return ErrTransactionAlreadyRetired
+		} else if ext.Dispute == DisputeOpen {
+			return ErrTransactionDisputed
+		}
 
-		if !message.Accepted {
-			return fmt.Errorf("Message not accepted: %v", message.RejectMessage)
+		sender, err := transactionSender(c, tx, address)
+		if err != nil {
+			return err
 		}
 
+		// A buyer rejecting a result whose delivery has been proven causes a dispute
+		disputable := deliveryProven(tx)
+
+		message := tx.SendMessage(now, sender, values)
+
+		// The signer, who may be a team member acting for the buyer or seller, can be
+		// told from the stored document and signature
 		message.Received = now
 		message.Document = document
 		message.Signature = signature
 
+		if !message.Accepted {
+			rejected = message
+			return storeRejectedMessage(c, txKey, tx, sender, message)
+		}
+
 		_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Tmessage", txKey), message)
 		if err != nil {
 			return err
 		}
 
-		if _, err := datastore.Put(c, txKey, datastore.PropertyLoadSaver(txCodec{tx})); err != nil {
+		if _, ok := values["rejectresult"]; ok {
+			ext.Rejected = true
+			if disputable {
+				if err := openDispute(c, txKey, tx, ext, now); err != nil {
+					return err
+				}
+			}
+		} else if _, ok := values["rejectwork"]; ok {
+			ext.Rejected = true
+		}
+
+		if _, err := datastore.Put(c, txKey, datastore.PropertyLoadSaver(txCodec{tx, ext})); err != nil {
 			return err
 		}
 
 		return addRetireTransactionTask(c, txKey.Encode(), tx)
 	}
 
-	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	} else if rejected != nil {
+		return &ConflictError{fmt.Sprintf("Message not accepted: %v", rejected.RejectMessage)}
+	}
+	return nil
 }
@@ -20,10 +20,12 @@ import (
 	"container/heap"
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/indyjo/bitwrk-common/bitwrk"
 	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/metrics"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/taskqueue"
@@ -37,11 +39,22 @@ import (
 // Only those informations necessary for matching and expiration are
 // held in a HotBid. When matched or expired, the HotBid is deleted from
 // the hot zone.
+//
+// Within a hot zone, bids are matched only with bids of the same lane.
+// Public bids share the empty lane, while directed bids are put into a lane
+// identified by buyer and seller (see bidLane).
+//
+// Participant and Signer are used to avoid matching bids of the same party
+// (see selfDealing). Like Lane, they are missing from hot bids stored by older
+// versions, which load as public bids with empty Participant and Signer.
 type hotBid struct {
-	BidKey  *datastore.Key
-	Type    bitwrk.BidType
-	Price   money.Money
-	Expires time.Time
+	BidKey      *datastore.Key
+	Lane        string
+	Type        bitwrk.BidType
+	Price       money.Money
+	Expires     time.Time
+	Participant string
+	Signer      string
 }
 
 // Function hotZoneKey returns a datastore key for a specific hot zone.
@@ -50,12 +63,44 @@ func hotZoneKey(c context.Context, matchKey string) *datastore.Key {
 	return datastore.NewKey(c, "ArticleEntity", "ac_"+matchKey, 0, nil)
 }
 
-func newHotBid(key *datastore.Key, bid *bitwrk.Bid) *hotBid {
+func newHotBid(key *datastore.Key, bid *bitwrk.Bid, ext *BidExtension) *hotBid {
+	signer := ""
+	if ext != nil {
+		signer = ext.Signer
+	}
 	return &hotBid{
 		BidKey:  key,
+		Lane:    bidLane(bid, ext),
 		Type:    bid.Type,
 		Price:   bid.Price,
-		Expires: bid.Expires}
+		Expires: bid.Expires,
+
+		Participant: bid.Participant,
+		Signer:      signer}
+}
+
+// Function bidLane returns the lane a bid is matched in. Public bids return the empty
+// string. A directed bid returns "<buyer>/<seller>", so that a buy directed at some
+// seller shares its lane with exactly those sells directed at that buyer.
+func bidLane(bid *bitwrk.Bid, ext *BidExtension) string {
+	if ext == nil || ext.Counterparty == "" {
+		return ""
+	} else if bid.Type == bitwrk.Buy {
+		return bid.Participant + "/" + ext.Counterparty
+	} else {
+		return ext.Counterparty + "/" + bid.Participant
+	}
+}
+
+// Returns whether two bids are placed by the same party, i.e. the same participant
+// or team, or a team and one of its members. Such bids must not be matched.
+func selfDealing(participant1, signer1, participant2, signer2 string) bool {
+	for _, a := range []string{participant1, signer1} {
+		if a != "" && (a == participant2 || a == signer2) {
+			return true
+		}
+	}
+	return false
 }
 
 func (this *hotBid) hotterThan(other *hotBid) bool {
@@ -105,6 +150,7 @@ func (h hotBidsHeap) Get(i int) hotBid { return h[i] }
 // treated as separate queues, but can be treated almost the same.
 type hotBidsQueue struct {
 	bidType    bitwrk.BidType
+	lane       string
 	context    context.Context
 	query      *datastore.Query
 	iter       *datastore.Iterator
@@ -112,9 +158,10 @@ type hotBidsQueue struct {
 	cachedHeap *hotBidsHeap
 }
 
-func newHotBidsQueue(c context.Context, query *datastore.Query, bidType bitwrk.BidType) *hotBidsQueue {
+func newHotBidsQueue(c context.Context, query *datastore.Query, bidType bitwrk.BidType, lane string) *hotBidsQueue {
 	return &hotBidsQueue{
 		bidType:    bidType,
+		lane:       lane,
 		context:    c,
 		query:      query,
 		iter:       nil,
@@ -132,18 +179,23 @@ func (q *hotBidsQueue) init() error {
 }
 
 func (q *hotBidsQueue) fetchNext() error {
-	var hot hotBid
-	if key, err := q.iter.Next(hotBidCodec{&hot}); err == datastore.Done {
-		q.storedTip = nil
-	} else if err != nil {
-		return err
-	} else {
-		q.storedTip = &storedHotBid{
-			key:    key,
-			hotBid: hot,
+	for {
+		var hot hotBid
+		if key, err := q.iter.Next(hotBidCodec{&hot}); err == datastore.Done {
+			q.storedTip = nil
+		} else if err != nil {
+			return err
+		} else if hot.Lane != q.lane {
+			// The public lane's query isn't filtered by lane (see newHotBidsLane)
+			continue
+		} else {
+			q.storedTip = &storedHotBid{
+				key:    key,
+				hotBid: hot,
+			}
 		}
+		return nil
 	}
-	return nil
 }
 
 func (q *hotBidsQueue) withTip(handleStoredTip, handleCachedTip func()) {
@@ -240,6 +292,7 @@ func MatchIncomingBids(c context.Context, matchKey string) error {
 	} else {
 		defer func() {
 			if err := taskqueue.DeleteMulti(c, tasks, "hotbids"); err != nil {
+				metrics.TaskFailures.Inc("hotbids")
 				log.Errorf(c, "Couldn't delete from task queue: %v", err)
 			}
 		}()
@@ -286,28 +339,67 @@ func deleteExpiredHotBids(c context.Context, now time.Time, matchKey string) err
 	return nil
 }
 
+// The pair of queues (buys and sells) belonging to one lane of a hot zone.
+type hotBidsLane struct {
+	buys, sells *hotBidsQueue
+}
+
+// Hot bids stored by older versions have no Lane property and would be missed by a
+// query filtering on it. As they are all public, the public lane queries all hot bids
+// and passes over those of other lanes in memory. Directed bids are rare, so this is cheap.
+func newHotBidsLane(c context.Context, parentKey *datastore.Key, lane string) *hotBidsLane {
+	hotBids := datastore.NewQuery("HotBid").Ancestor(parentKey)
+	if lane != "" {
+		hotBids = hotBids.Filter("Lane=", lane)
+	}
+	return &hotBidsLane{
+		buys:  newHotBidsQueue(c, hotBids.Filter("Type=", bitwrk.Buy).Order("-Price"), bitwrk.Buy, lane),
+		sells: newHotBidsQueue(c, hotBids.Filter("Type=", bitwrk.Sell).Order("Price"), bitwrk.Sell, lane),
+	}
+}
+
+// Maximum number of bids of the same party passed over when looking for a match
+const maxPassedOverBids = 20
+
 // Takes a list of hot bids, all belonging to the same article/currency, and tries to match them against
-// existing bids, in sequence.
+// existing bids of the same lane, in sequence.
 func matchIncomingBids(c context.Context, now time.Time, matchKey string, incomingBids []hotBid) error {
 	log.Infof(c, "Matching hot bids [%v]: %v", matchKey, incomingBids)
 
 	parentKey := hotZoneKey(c, matchKey)
-	hotBids := datastore.NewQuery("HotBid").Ancestor(parentKey)
 
-	hotBuys := newHotBidsQueue(c, hotBids.Filter("Type=", bitwrk.Buy).Order("-Price"), bitwrk.Buy)
-	hotSells := newHotBidsQueue(c, hotBids.Filter("Type=", bitwrk.Sell).Order("Price"), bitwrk.Sell)
+	// Lanes are created lazily, so directed bids don't cost anything unless they occur
+	lanes := make(map[string]*hotBidsLane)
+	laneNames := make([]string, 0, 4)
 
 	matched := make([]string, 0, 16)
 
+	// Bids of suspended participants are withdrawn instead of being matched. Most are
+	// withdrawn on suspension, but not those stored before that could find them.
+	suspensions := newSuspensionCache(now)
+
 	for len(incomingBids) > 0 {
 		bid := incomingBids[0]
 		incomingBids = incomingBids[1:]
 
+		if withdrawn, err := suspensions.withdrawIfSuspended(c, &bid); err != nil {
+			return err
+		} else if withdrawn {
+			continue
+		}
+
+		lane, ok := lanes[bid.Lane]
+		if !ok {
+			lane = newHotBidsLane(c, parentKey, bid.Lane)
+			lanes[bid.Lane] = lane
+			laneNames = append(laneNames, bid.Lane)
+		}
+
 		var thisQueue, otherQueue *hotBidsQueue
 		if bid.Type == bitwrk.Buy {
-			thisQueue, otherQueue = hotBuys, hotSells
+			thisQueue, otherQueue = lane.buys, lane.sells
 		} else {
-			thisQueue, otherQueue = hotSells, hotBuys
+			thisQueue, otherQueue = lane.sells, lane.buys
 		}
 
 		// Pop bids from queue that have expired
@@ -327,16 +419,47 @@ func matchIncomingBids(c context.Context, now time.Time, matchKey string, incomi
 		}
 		log.Infof(c, "Skipped %v expired bids", skipped)
 
-		// See if we have a match
-		if other, err := otherQueue.Tip(); err != nil {
-			return err
-		} else if other != nil && other.hotterThan(&bid) {
-			// This is a match. Take other bid out of queue and schedule transaction creation
-			if err := otherQueue.Pop(); err != nil {
+		// See if we have a match. Bids of the same party are passed over and put back
+		// into the queue afterwards.
+		var match *hotBid
+		passedOver := make([]hotBid, 0, 4)
+		for len(passedOver) < maxPassedOverBids {
+			if other, err := otherQueue.Tip(); err != nil {
+				return err
+			} else if other == nil || !other.hotterThan(&bid) {
+				break
+			} else if err := otherQueue.Pop(); err != nil {
+				return err
+			} else if selfDealing(bid.Participant, bid.Signer, other.Participant, other.Signer) {
+				log.Infof(c, "Not matching bid %v with bid %v of the same party", bid.BidKey, other.BidKey)
+				passedOver = append(passedOver, *other)
+			} else if withdrawn, err := suspensions.withdrawIfSuspended(c, other); err != nil {
+				return err
+			} else if withdrawn {
+				continue
+			} else {
+				match = other
+				break
+			}
+		}
+		if match == nil && len(passedOver) == maxPassedOverBids {
+			// The bid is stored although the book may hold hotter bids of other parties
+			if other, err := otherQueue.Tip(); err != nil {
+				return err
+			} else if other != nil && other.hotterThan(&bid) {
+				log.Warningf(c, "Gave up matching bid %v after passing over %v bids of the same party; book is left crossed",
+					bid.BidKey, maxPassedOverBids)
+			}
+		}
+		for i := range passedOver {
+			if err := otherQueue.Insert(&passedOver[i]); err != nil {
 				return err
 			}
+		}
 
-			matched = append(matched, bid.BidKey.Encode(), other.BidKey.Encode())
+		if match != nil {
+			// This is a match. Schedule transaction creation
+			matched = append(matched, bid.BidKey.Encode(), match.BidKey.Encode())
 		} else {
 			// No match. Store bid for later matching.
 			if err := thisQueue.Insert(&bid); err != nil {
@@ -345,15 +468,19 @@ func matchIncomingBids(c context.Context, now time.Time, matchKey string, incomi
 		}
 	}
 
-	if err := hotBuys.Persist(parentKey); err != nil {
-		return err
-	}
-	if err := hotSells.Persist(parentKey); err != nil {
-		return err
+	placed := make([]string, 0, 16)
+	for _, name := range laneNames {
+		lane := lanes[name]
+		if err := lane.buys.Persist(parentKey); err != nil {
+			return err
+		}
+		if err := lane.sells.Persist(parentKey); err != nil {
+			return err
+		}
+		placed = append(placed, lane.buys.Flush()...)
+		placed = append(placed, lane.sells.Flush()...)
 	}
 
-	placed := append(hotBuys.Flush(), hotSells.Flush()...)
-
 	if len(matched) == 0 && len(placed) == 0 {
 		return nil
 	} else {
@@ -361,6 +488,35 @@ func matchIncomingBids(c context.Context, now time.Time, matchKey string, incomi
 	}
 }
 
+// Puts a bid refused by MatchBids back into its hot zone, where it waits for another
+// match instead of keeping its funds blocked until it expires. Retired bids are left out.
+// Must be called inside a transaction.
+func returnToHotZone(c context.Context, key *datastore.Key, bid *bitwrk.Bid, ext *BidExtension) error {
+	if bid.State == bitwrk.Expired {
+		return nil
+	}
+	if bid.State == bitwrk.InQueue {
+		// PlaceBid may not have got to the bid yet, due to asynchronicity
+		bid.State = bitwrk.Placed
+		if _, err := datastore.Put(c, key, datastore.PropertyLoadSaver(bidCodec{bid, ext})); err != nil {
+			return err
+		}
+	}
+	hotKey := datastore.NewIncompleteKey(c, "HotBid", hotZoneKey(c, bid.MatchKey()))
+	_, err := datastore.Put(c, hotKey, datastore.PropertyLoadSaver(hotBidCodec{newHotBid(key, bid, ext)}))
+	return err
+}
+
+// Returned by MatchBids if two bids must not be matched with each other. This is a
+// deliberate decision rather than a failure.
+type MatchRefusedError struct {
+	Message string
+}
+
+func (e *MatchRefusedError) Error() string {
+	return e.Message
+}
+
 // Given IDs of two bids, matches both in a transaction.
 func MatchBids(c context.Context, matched time.Time, newBidId, oldBidId string) error {
 	newKey, err := datastore.DecodeKey(newBidId)
@@ -372,15 +528,38 @@ func MatchBids(c context.Context, matched time.Time, newBidId, oldBidId string)
 		return err
 	}
 
+	var article bitwrk.ArticleId
+	var refused *MatchRefusedError
 	f := func(c context.Context) error {
+		refused = nil
 		var newBid, oldBid bitwrk.Bid
-		if err := datastore.Get(c, newKey, bidCodec{&newBid}); err != nil {
+		var newExt, oldExt BidExtension
+		if err := datastore.Get(c, newKey, bidCodec{&newBid, &newExt}); err != nil {
 			return err
 		}
-		if err := datastore.Get(c, oldKey, bidCodec{&oldBid}); err != nil {
+		article = newBid.Article
+		if err := datastore.Get(c, oldKey, bidCodec{&oldBid, &oldExt}); err != nil {
 			return err
 		}
 
+		// Bids withdrawn while waiting for matching (e.g. of a suspended participant)
+		if newBid.State == bitwrk.Expired || oldBid.State == bitwrk.Expired {
+			refused = &MatchRefusedError{fmt.Sprintf("Bids %v and %v can't be matched, as one of them has been retired", newBidId, oldBidId)}
+		} else if selfDealing(newBid.Participant, newExt.Signer, oldBid.Participant, oldExt.Signer) {
+			// Refuse wash trades, which hot bids stored by older versions don't protect against
+			refused = &MatchRefusedError{fmt.Sprintf("Bids %v and %v can't be matched, as they were placed by the same party", newBidId, oldBidId)}
+		} else if bidLane(&newBid, &newExt) != bidLane(&oldBid, &oldExt) {
+			// Directed bids must only ever be matched with their counterparty
+			refused = &MatchRefusedError{fmt.Sprintf("Bids %v and %v were matched across lanes", newBidId, oldBidId)}
+		}
+		if refused != nil {
+			// Both bids have left the hot zone for this match
+			if err := returnToHotZone(c, newKey, &newBid, &newExt); err != nil {
+				return err
+			}
+			return returnToHotZone(c, oldKey, &oldBid, &oldExt)
+		}
+
 		// Older bid may still be in state InQueue, due to asynchronicity
 		if oldBid.State == bitwrk.InQueue {
 			oldBid.State = bitwrk.Placed
@@ -394,8 +573,18 @@ func MatchBids(c context.Context, matched time.Time, newBidId, oldBidId string)
 			tx = t
 		}
 
+		// The server decides which price the transaction is closed at
+		var ext TxExtension
+		if rule, err := priceRuleForArticle(tx.Article); err != nil {
+			return err
+		} else {
+			applyPriceRule(tx, rule, &newBid, &oldBid)
+			ext.PriceRule = rule
+		}
+		applyFeeRule(tx, &ext, &newBid, &oldBid)
+
 		if txKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tx", nil),
-			datastore.PropertyLoadSaver(txCodec{tx})); err != nil {
+			datastore.PropertyLoadSaver(txCodec{tx, &ext})); err != nil {
 			// Error writing transaction
 			return err
 		} else {
@@ -404,24 +593,37 @@ func MatchBids(c context.Context, matched time.Time, newBidId, oldBidId string)
 			// Store both bids and schedule the transaction's retirement
 
 			newBid.Transaction = &txKeyEncoded
-			if _, err := datastore.Put(c, newKey, datastore.PropertyLoadSaver(bidCodec{&newBid})); err != nil {
+			if _, err := datastore.Put(c, newKey, datastore.PropertyLoadSaver(bidCodec{&newBid, &newExt})); err != nil {
 				return err
 			}
 
 			oldBid.Transaction = &txKeyEncoded
-			if _, err := datastore.Put(c, oldKey, datastore.PropertyLoadSaver(bidCodec{&oldBid})); err != nil {
+			if _, err := datastore.Put(c, oldKey, datastore.PropertyLoadSaver(bidCodec{&oldBid, &oldExt})); err != nil {
 				return err
 			}
 
 			if err := addRetireTransactionTask(c, txKeyEncoded, tx); err != nil {
 				return err
 			}
+			if err := addAggregatePriceTask(c, txKeyEncoded, tx); err != nil {
+				return err
+			}
 
 			var buyerBid *bitwrk.Bid
+			var buyerExt *BidExtension
 			if newBid.Type == bitwrk.Buy {
-				buyerBid = &newBid
+				buyerBid, buyerExt = &newBid, &newExt
 			} else {
-				buyerBid = &oldBid
+				buyerBid, buyerExt = &oldBid, &oldExt
+			}
+
+			// A team member has been charged the bid's price and fee, which may be
+			// more than the transaction's
+			if buyerExt.Signer != "" {
+				excess := bidSpend(buyerBid) - tx.Price.Amount - tx.Fee.Amount
+				if err := refundTeamMember(c, buyerBid, buyerExt.Signer, excess); err != nil {
+					return err
+				}
 			}
 
 			dao := NewGaeAccountingDao(c, true)
@@ -433,5 +635,12 @@ func MatchBids(c context.Context, matched time.Time, newBidId, oldBidId string)
 		}
 	}
 
-	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return err
+	} else if refused != nil {
+		return refused
+	}
+
+	metrics.BidsMatched.Add(2, string(article))
+	return nil
 }
@@ -0,0 +1,91 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/indyjo/bitwrk/server/metrics"
+	"google.golang.org/appengine/datastore"
+)
+
+// Number of entities metric totals are spread over, so that instances rarely contend
+// when storing their increments.
+const metricShards = 16
+
+// Part of the metric totals, stored in "MetricShard" entities. Series and Values are
+// parallel lists; series keys are opaque and produced by the metrics package.
+type metricShard struct {
+	Series []string  `datastore:",noindex"`
+	Values []float64 `datastore:",noindex"`
+}
+
+// Adds the metric increments collected by this instance to a randomly chosen shard.
+// If that fails, the increments are kept for the next attempt.
+func FlushMetrics(c context.Context) error {
+	increments := metrics.TakePending()
+	if len(increments) == 0 {
+		return nil
+	}
+
+	key := datastore.NewKey(c, "MetricShard", "", int64(1+rand.Intn(metricShards)), nil)
+	f := func(c context.Context) error {
+		var shard metricShard
+		if err := datastore.Get(c, key, &shard); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		index := make(map[string]int, len(shard.Series))
+		for i, series := range shard.Series {
+			index[series] = i
+		}
+		for series, v := range increments {
+			if i, ok := index[series]; ok {
+				shard.Values[i] += v
+			} else {
+				shard.Series = append(shard.Series, series)
+				shard.Values = append(shard.Values, v)
+			}
+		}
+		_, err := datastore.Put(c, key, &shard)
+		return err
+	}
+
+	if err := datastore.RunInTransaction(c, f, nil); err != nil {
+		metrics.Requeue(increments)
+		return err
+	}
+	return nil
+}
+
+// Returns the metric totals of all instances, summed up over all shards.
+func LoadMetrics(c context.Context) (map[string]float64, error) {
+	var shards []metricShard
+	if _, err := datastore.NewQuery("MetricShard").GetAll(c, &shards); err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]float64)
+	for _, shard := range shards {
+		for i, series := range shard.Series {
+			if i < len(shard.Values) {
+				totals[series] += shard.Values[i]
+			}
+		}
+	}
+	return totals, nil
+}
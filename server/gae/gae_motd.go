@@ -0,0 +1,87 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Severities of messages of the day, from least to most severe
+const (
+	SeverityInfo    = "info"
+	SeveritySuccess = "success"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Maximum number of message of the day entries considered
+const maxMotdEntries = 100
+
+// A message of the day, as defined by the admin. Empty version bounds and zero
+// times leave the respective range open. Entries with an article are notices
+// concerning that article only.
+type MotdEntry struct {
+	Id         string    `datastore:"-"`
+	Text       string    `datastore:",noindex"`
+	Severity   string    `datastore:",noindex"`
+	MinVersion string    `datastore:",noindex"` // Inclusive
+	MaxVersion string    `datastore:",noindex"` // Inclusive
+	ValidFrom  time.Time `datastore:",noindex"`
+	ValidUntil time.Time `datastore:",noindex"`
+	Article    string    `datastore:",noindex"`
+	Updated    time.Time
+	Document   string `datastore:",noindex"`
+	Signature  string `datastore:",noindex"`
+}
+
+func MotdKey(c context.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Motd", id, 0, nil)
+}
+
+// Returns whether the entry is valid at the given time.
+func (m *MotdEntry) ValidAt(now time.Time) bool {
+	return (m.ValidFrom.IsZero() || !now.Before(m.ValidFrom)) &&
+		(m.ValidUntil.IsZero() || now.Before(m.ValidUntil))
+}
+
+// Creates or replaces a message of the day.
+func SaveMotd(c context.Context, entry *MotdEntry) error {
+	_, err := datastore.Put(c, MotdKey(c, entry.Id), entry)
+	return err
+}
+
+// Deletes a message of the day. Deleting a non-existing entry is not an error.
+func DeleteMotd(c context.Context, id string) error {
+	return datastore.Delete(c, MotdKey(c, id))
+}
+
+// Returns all messages of the day, most recently updated first.
+func QueryMotds(c context.Context) ([]MotdEntry, error) {
+	query := datastore.NewQuery("Motd").Order("-Updated").Limit(maxMotdEntries)
+	entries := make([]MotdEntry, 0, 8)
+	keys, err := query.GetAll(c, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		entries[i].Id = key.StringID()
+	}
+	return entries, nil
+}
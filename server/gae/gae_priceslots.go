@@ -0,0 +1,219 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// A resolution at which price statistics are kept
+type PriceResolution struct {
+	Name     string
+	Interval time.Duration
+}
+
+// The resolutions of price statistics, from coarsest to finest
+var PriceResolutions = []PriceResolution{
+	{"1y", 9 * 42 * 24 * time.Hour},
+	{"6w", 42 * 24 * time.Hour},
+	{"1w", 7 * 24 * time.Hour},
+	{"1d", 24 * time.Hour},
+	{"6h", 6 * time.Hour},
+	{"1h", 1 * time.Hour},
+	{"12m", 12 * time.Minute},
+	{"3m", 3 * time.Minute},
+	{"30s", 30 * time.Second},
+	{"6s", 6 * time.Second},
+	{"1s", 1 * time.Second},
+}
+
+// Price statistics of an article's transactions matched within a time slot. Slots
+// begin at multiples of their resolution's interval and are only stored once a
+// transaction falls into them. Fees and outcomes are added when transactions are
+// retired, to the slot they were matched in.
+type PriceSlot struct {
+	Article    string
+	Currency   string
+	Resolution string
+	Begin      time.Time
+	End        time.Time `datastore:",noindex"`
+	Sum        int64     `datastore:",noindex"`
+	Min        int64     `datastore:",noindex"`
+	Max        int64     `datastore:",noindex"`
+	Count      int       `datastore:",noindex"`
+	Open       int64     `datastore:",noindex"` // Price of the slot's first transaction
+	OpenTime   time.Time `datastore:",noindex"`
+	Close      int64     `datastore:",noindex"` // Price of the slot's last transaction
+	CloseTime  time.Time `datastore:",noindex"`
+	Fees       int64     `datastore:",noindex"` // Fees charged on retired transactions
+	Finished   int       `datastore:",noindex"` // Retired transactions that delivered a result
+	Failed     int       `datastore:",noindex"` // Retired transactions that didn't
+}
+
+func priceSlotKey(c context.Context, resolution string, article ArticleId, currency string, begin time.Time) *datastore.Key {
+	return datastore.NewKey(c, "PriceSlot", fmt.Sprintf("%v/%v/%v/%v", resolution, article, currency, begin.Unix()), 0, nil)
+}
+
+func (s *PriceSlot) addPrice(matched time.Time, price int64) {
+	if s.Count == 0 || matched.Before(s.OpenTime) {
+		s.Open, s.OpenTime = price, matched
+	}
+	if s.Count == 0 || !matched.Before(s.CloseTime) {
+		s.Close, s.CloseTime = price, matched
+	}
+	if s.Count == 0 || price < s.Min {
+		s.Min = price
+	}
+	if s.Count == 0 || price > s.Max {
+		s.Max = price
+	}
+	s.Sum += price
+	s.Count++
+}
+
+func (s *PriceSlot) addRetirement(fee int64, finished bool) {
+	s.Fees += fee
+	if finished {
+		s.Finished++
+	} else {
+		s.Failed++
+	}
+}
+
+// Adds a transaction's price and, once it is retired, its fee and outcome to the price
+// statistics at every resolution, unless this has been done before. Tasks of an
+// article are run one at a time, so slots aren't contended.
+func AggregatePrice(c context.Context, key *datastore.Key) error {
+	f := func(c context.Context) error {
+		tx, ext, err := GetTransaction(c, key)
+		if err != nil {
+			return err
+		}
+		retired := tx.State == StateRetired
+		if ext.Aggregated && (!retired || ext.RetirementAggregated) {
+			log.Infof(c, "Transaction %v has been aggregated already", key)
+			return nil
+		}
+
+		// Transactions that got as far as delivering a result count as finished
+		finished := tx.Phase == PhaseUnverified || tx.Phase == PhaseFinished
+
+		currency := tx.Price.Currency.String()
+		for _, res := range PriceResolutions {
+			begin := tx.Matched.Truncate(res.Interval)
+			slotKey := priceSlotKey(c, res.Name, tx.Article, currency, begin)
+			var slot PriceSlot
+			if err := datastore.Get(c, slotKey, &slot); err == datastore.ErrNoSuchEntity {
+				slot = PriceSlot{
+					Article:    string(tx.Article),
+					Currency:   currency,
+					Resolution: res.Name,
+					Begin:      begin,
+					End:        begin.Add(res.Interval),
+				}
+			} else if err != nil {
+				return err
+			}
+			if !ext.Aggregated {
+				slot.addPrice(tx.Matched, tx.Price.Amount)
+			}
+			if retired && !ext.RetirementAggregated {
+				slot.addRetirement(ChargedFee(tx, ext).Amount, finished)
+			}
+			if _, err := datastore.Put(c, slotKey, &slot); err != nil {
+				return err
+			}
+		}
+
+		ext.Aggregated = true
+		ext.RetirementAggregated = retired
+		_, err = datastore.Put(c, key, datastore.PropertyLoadSaver(txCodec{tx, ext}))
+		return err
+	}
+
+	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+}
+
+// Schedules aggregation of up to limit transactions that haven't been fully added
+// to the price statistics yet, continuing at the given cursor. Needed once for
+// transactions created before statistics were kept. Returns the number of tasks
+// scheduled and the cursor to continue with, which is empty when done.
+func ScheduleMissingAggregations(c context.Context, cursor string, limit int) (int, string, error) {
+	query := datastore.NewQuery("Tx").Order("__key__").Limit(limit)
+	if cursor != "" {
+		if cur, err := datastore.DecodeCursor(cursor); err != nil {
+			return 0, "", err
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	scheduled, count := 0, 0
+	for {
+		var tx Transaction
+		var ext TxExtension
+		key, err := iter.Next(txCodec{&tx, &ext})
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return scheduled, "", err
+		}
+		count++
+		if !ext.Aggregated || (tx.State == StateRetired && !ext.RetirementAggregated) {
+			if err := addAggregatePriceTask(c, key.Encode(), &tx); err != nil {
+				return scheduled, "", err
+			}
+			scheduled++
+		}
+	}
+
+	if count < limit {
+		return scheduled, "", nil
+	} else if cur, err := iter.Cursor(); err != nil {
+		return scheduled, "", err
+	} else {
+		return scheduled, cur.String(), nil
+	}
+}
+
+// Returns the price statistics of an article at the given resolution, for the slots
+// beginning within [begin, end), in chronological order. Slots without transactions
+// are left out.
+func QueryPriceSlots(c context.Context, article ArticleId, currency money.Currency, resolution string,
+	begin, end time.Time, limit int) ([]PriceSlot, error) {
+	query := datastore.NewQuery("PriceSlot").
+		Filter("Resolution =", resolution).
+		Filter("Article =", string(article)).
+		Filter("Currency =", currency.String()).
+		Filter("Begin >=", begin).
+		Filter("Begin <", end).
+		Order("Begin").
+		Limit(limit)
+	slots := make([]PriceSlot, 0, 64)
+	if _, err := query.GetAll(c, &slots); err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
@@ -0,0 +1,87 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+)
+
+// A PriceRule decides which price a transaction is closed at, given the
+// incoming (aggressing) bid and the resting bid it was matched with.
+type PriceRule string
+
+const (
+	PriceRuleResting   PriceRule = "resting"   // Price of the bid that rested in the book
+	PriceRuleMidpoint  PriceRule = "midpoint"  // Midpoint between buy and sell price
+	PriceRuleAggressor PriceRule = "aggressor" // Price of the incoming bid
+	PriceRuleBuyer     PriceRule = "buyer"     // Price of the buy bid
+)
+
+func ParsePriceRule(s string) (PriceRule, error) {
+	switch rule := PriceRule(s); rule {
+	case PriceRuleResting, PriceRuleMidpoint, PriceRuleAggressor, PriceRuleBuyer:
+		return rule, nil
+	default:
+		return "", fmt.Errorf("Unknown price rule: %#v", s)
+	}
+}
+
+// Returns the price rule configured for the given article.
+func priceRuleForArticle(article bitwrk.ArticleId) (PriceRule, error) {
+	return ParsePriceRule(config.GetArticleSettings(string(article)).PriceRule)
+}
+
+// Returns the price at which a transaction between the two bids is closed.
+func (rule PriceRule) price(incoming, resting *bitwrk.Bid) money.Money {
+	buy, sell := incoming, resting
+	if buy.Type != bitwrk.Buy {
+		buy, sell = sell, buy
+	}
+
+	switch rule {
+	case PriceRuleMidpoint:
+		price := buy.Price
+		price.Amount = sell.Price.Amount + (buy.Price.Amount-sell.Price.Amount)/2
+		return price
+	case PriceRuleAggressor:
+		return incoming.Price
+	case PriceRuleBuyer:
+		return buy.Price
+	default:
+		return resting.Price
+	}
+}
+
+// Function applyPriceRule modifies a freshly created transaction so that its price
+// conforms to the given rule. The fee is left to applyFeeRule, which must be called
+// afterwards.
+func applyPriceRule(tx *bitwrk.Transaction, rule PriceRule, incoming, resting *bitwrk.Bid) {
+	tx.Price.Amount = rule.price(incoming, resting).Amount
+}
+
+// Returns amount * numerator / denominator, without risking an overflow in between.
+func scaleAmount(amount, numerator, denominator int64) int64 {
+	result := big.NewInt(amount)
+	result.Mul(result, big.NewInt(numerator))
+	result.Quo(result, big.NewInt(denominator))
+	return result.Int64()
+}
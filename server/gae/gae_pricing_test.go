@@ -0,0 +1,60 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"testing"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+)
+
+func TestApplyPriceRule(t *testing.T) {
+	btc := func(amount int64) money.Money { return money.Money{Currency: money.BTC, Amount: amount} }
+	buy := &Bid{Type: Buy, Price: btc(100)}
+	sell := &Bid{Type: Sell, Price: btc(80)}
+
+	for _, c := range []struct {
+		rule              PriceRule
+		incoming, resting *Bid
+		price, fee        int64
+	}{
+		// The transaction starts out at the resting bid's price. The fee is left alone.
+		{PriceRuleResting, buy, sell, 80, 8},
+		{PriceRuleResting, sell, buy, 100, 10},
+		{PriceRuleMidpoint, buy, sell, 90, 8},
+		{PriceRuleMidpoint, sell, buy, 90, 10},
+		{PriceRuleAggressor, buy, sell, 100, 8},
+		{PriceRuleAggressor, sell, buy, 80, 10},
+		{PriceRuleBuyer, buy, sell, 100, 8},
+		{PriceRuleBuyer, sell, buy, 100, 10},
+	} {
+		tx := &Transaction{Price: c.resting.Price, Fee: btc(c.resting.Price.Amount / 10)}
+		applyPriceRule(tx, c.rule, c.incoming, c.resting)
+		if tx.Price.Amount != c.price || tx.Fee.Amount != c.fee {
+			t.Errorf("Rule %v, incoming %v at %v: Expected price %v and fee %v, got %v and %v",
+				c.rule, c.incoming.Type, c.incoming.Price.Amount, c.price, c.fee, tx.Price.Amount, tx.Fee.Amount)
+		}
+	}
+
+	// The midpoint is rounded down
+	tx := &Transaction{Price: btc(80)}
+	applyPriceRule(tx, PriceRuleMidpoint, &Bid{Type: Buy, Price: btc(101)}, sell)
+	if tx.Price.Amount != 90 {
+		t.Errorf("Expected price 90, got %v", tx.Price.Amount)
+	}
+}
@@ -47,9 +47,10 @@ func QueryAccountKeys(c context.Context, limit int, requestdepositaddress bool,
 	return nil
 }
 
-type TxFunc func(key string, tx bitwrk.Transaction)
+type TxFunc func(key string, tx bitwrk.Transaction, ext TxExtension)
 
-// Queries transactions matching the given constraints. Invokes handler func for every transaction found.
+// Queries transactions matching the given constraints. Invokes handler func for every transaction found,
+// in order of matching. Archived transactions are included, as far as they have been kept.
 func QueryTransactions(c context.Context, limit int, article bitwrk.ArticleId, currency money.Currency,
 	begin, end time.Time, handler TxFunc) error {
 	query := datastore.NewQuery("Tx").Limit(limit)
@@ -59,18 +60,68 @@ func QueryTransactions(c context.Context, limit int, article bitwrk.ArticleId, c
 	query = query.Filter("Matched <", end)
 	query = query.Order("Matched")
 
+	archiveQuery := datastore.NewQuery("ArchivedTx").Limit(limit)
+	archiveQuery = archiveQuery.Filter("Article =", string(article))
+	archiveQuery = archiveQuery.Filter("Currency =", currency.String())
+	archiveQuery = archiveQuery.Filter("Matched >=", begin)
+	archiveQuery = archiveQuery.Filter("Matched <", end)
+	archiveQuery = archiveQuery.Order("Matched")
+
 	iter := query.Run(c)
+	archiveIter := archiveQuery.Run(c)
 
-	for {
-		var tx bitwrk.Transaction
+	// Advances to the next transaction. key is nil when there are no more.
+	var tx bitwrk.Transaction
+	var ext TxExtension
+	var key *datastore.Key
+	next := func() error {
+		tx, ext = bitwrk.Transaction{}, TxExtension{}
+		if k, err := iter.Next(txCodec{&tx, &ext}); err == datastore.Done {
+			key = nil
+		} else if err != nil {
+			return err
+		} else {
+			key = k
+		}
+		return nil
+	}
 
-		// Iterate transactions in datastore
-		if key, err := iter.Next(txCodec{&tx}); err == datastore.Done {
-			break
+	// Advances to the next archived transaction. archivedKey is nil when there are no more.
+	var archived ArchivedTx
+	var archivedKey *datastore.Key
+	nextArchived := func() error {
+		archived = ArchivedTx{}
+		if k, err := archiveIter.Next(&archived); err == datastore.Done {
+			archivedKey = nil
 		} else if err != nil {
 			return err
 		} else {
-			handler(key.Encode(), tx)
+			archivedKey = k
+		}
+		return nil
+	}
+
+	if err := next(); err != nil {
+		return err
+	}
+	if err := nextArchived(); err != nil {
+		return err
+	}
+
+	// Merge both by time of matching
+	for count := 0; count < limit && (key != nil || archivedKey != nil); count++ {
+		if archivedKey == nil || (key != nil && !archived.Matched.Before(tx.Matched)) {
+			handler(key.Encode(), tx, ext)
+			if err := next(); err != nil {
+				return err
+			}
+		} else {
+			archivedTx, archivedExt := archived.transaction()
+			txKey := datastore.NewKey(c, "Tx", archivedKey.StringID(), archivedKey.IntID(), nil)
+			handler(txKey.Encode(), *archivedTx, *archivedExt)
+			if err := nextArchived(); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -105,3 +156,117 @@ func QueryAccountMovements(c context.Context, begin time.Time, limit int) ([]bit
 
 	return result, nil
 }
+
+// Queries a transaction's messages (both accepted and rejected ones) in the order they
+// were received. Continues after the given cursor, unless it is empty. Returns the
+// cursor to continue with, which is empty if there are no more messages.
+func QueryTransactionMessages(c context.Context, txKey *datastore.Key, cursor string, limit int) ([]bitwrk.Tmessage, string, error) {
+	result := make([]bitwrk.Tmessage, 0, limit)
+
+	query := datastore.NewQuery("Tmessage").Ancestor(txKey).Order("Received").Limit(limit)
+	if cursor != "" {
+		if c, err := datastore.DecodeCursor(cursor); err != nil {
+			return nil, "", err
+		} else {
+			query = query.Start(c)
+		}
+	}
+	iter := query.Run(c)
+
+	for {
+		var message bitwrk.Tmessage
+		if _, err := iter.Next(&message); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		} else {
+			result = append(result, message)
+		}
+	}
+
+	// A page that isn't full is the last one
+	if len(result) < limit {
+		return result, "", nil
+	}
+
+	if next, err := iter.Cursor(); err != nil {
+		return nil, "", err
+	} else {
+		return result, next.String(), nil
+	}
+}
+
+// Queries an article's retired transactions, most recently retired first, continuing after
+// the given cursor unless it is empty. Invokes handler func for every transaction found.
+// Returns the cursor to continue with, which is empty if there are no more transactions.
+// Only transactions retired since the retirement time has been recorded are found.
+func QueryRecentlyRetiredTransactions(c context.Context, article bitwrk.ArticleId, cursor string, limit int,
+	handler TxFunc) (string, error) {
+	query := datastore.NewQuery("Tx").Filter("Article =", article).Order("-Retired").Limit(limit)
+	if cursor != "" {
+		if cur, err := datastore.DecodeCursor(cursor); err != nil {
+			return "", err
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	count := 0
+	for {
+		var tx bitwrk.Transaction
+		var ext TxExtension
+		if key, err := iter.Next(txCodec{&tx, &ext}); err == datastore.Done {
+			break
+		} else if err != nil {
+			return "", err
+		} else {
+			handler(key.Encode(), tx, ext)
+			count++
+		}
+	}
+
+	// A page that isn't full is the last one
+	if count < limit {
+		return "", nil
+	} else if next, err := iter.Cursor(); err != nil {
+		return "", err
+	} else {
+		return next.String(), nil
+	}
+}
+
+// Queries an article's transactions retired at or after the given time, in the order
+// they were retired, continuing after the given cursor unless it is empty. Invokes
+// handler func for every transaction found. Returns the cursor to continue with, which
+// is never empty: Transactions retired later are found when continuing.
+func QueryTransactionsRetiredSince(c context.Context, article bitwrk.ArticleId, since time.Time, cursor string,
+	limit int, handler TxFunc) (string, error) {
+	query := datastore.NewQuery("Tx").Filter("Article =", article).Filter("Retired >=", since).Order("Retired").Limit(limit)
+	if cursor != "" {
+		if cur, err := datastore.DecodeCursor(cursor); err != nil {
+			return "", err
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	for {
+		var tx bitwrk.Transaction
+		var ext TxExtension
+		if key, err := iter.Next(txCodec{&tx, &ext}); err == datastore.Done {
+			break
+		} else if err != nil {
+			return "", err
+		} else {
+			handler(key.Encode(), tx, ext)
+		}
+	}
+
+	if next, err := iter.Cursor(); err != nil {
+		return "", err
+	} else {
+		return next.String(), nil
+	}
+}
@@ -74,6 +74,21 @@ func addRetireTransactionTask(c context.Context, txKey string, tx *bitwrk.Transa
 		url.Values{"tx": {txKey}})
 }
 
+func addCollectFeeTask(c context.Context, txKey string, tx *bitwrk.Transaction) error {
+	return addTaskForArticle(c, tx.MatchKey(), "collect-fee", txKey, time.Time{}, time.Duration(0),
+		url.Values{"tx": {txKey}})
+}
+
+func addAggregatePriceTask(c context.Context, txKey string, tx *bitwrk.Transaction) error {
+	return addTaskForArticle(c, tx.MatchKey(), "aggregate-price", txKey, time.Time{}, time.Duration(0),
+		url.Values{"tx": {txKey}})
+}
+
+func addSettleDisputeTask(c context.Context, txKey string, tx *bitwrk.Transaction, eta time.Time) error {
+	return addTaskForArticle(c, tx.MatchKey(), "settle-dispute", txKey, eta, time.Duration(0),
+		url.Values{"tx": {txKey}})
+}
+
 func addRetireBidTask(c context.Context, bidKey string, bid *bitwrk.Bid) error {
 	return addTaskForArticle(c, bid.MatchKey(), "retire-bid", bidKey, bid.Expires, time.Duration(0),
 		url.Values{"bid": {bidKey}})
@@ -0,0 +1,86 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Kinds whose entities ReindexEntities rewrites. Bids stored by older versions lack
+// indexed Participant and State, transactions lack indexed Buyer, Seller and State.
+var ReindexKinds = []string{"Bid", "Tx"}
+
+// Rewrites up to limit entities of a kind, in key order, continuing after cursor
+// unless it is empty, so that they are stored with the properties and indexes of the
+// current codec. Returns the number of entities rewritten and the cursor to continue
+// with, which is empty if there are no more entities.
+func ReindexEntities(c context.Context, kind, cursor string, limit int) (int, string, error) {
+	found := false
+	for _, k := range ReindexKinds {
+		found = found || k == kind
+	}
+	if !found {
+		return 0, "", fmt.Errorf("Kind can't be reindexed: %#v", kind)
+	}
+
+	query := datastore.NewQuery(kind).Order("__key__").KeysOnly().Limit(limit)
+	if cursor != "" {
+		if cur, err := datastore.DecodeCursor(cursor); err != nil {
+			return 0, "", err
+		} else {
+			query = query.Start(cur)
+		}
+	}
+
+	iter := query.Run(c)
+	count := 0
+	for {
+		key, err := iter.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return count, "", err
+		}
+		if err := reindexEntity(c, key); err != nil {
+			return count, "", err
+		}
+		count++
+	}
+
+	if count < limit {
+		return count, "", nil
+	} else if cur, err := iter.Cursor(); err != nil {
+		return count, "", err
+	} else {
+		return count, cur.String(), nil
+	}
+}
+
+// Loads and stores an entity in a transaction, so concurrent changes aren't lost.
+func reindexEntity(c context.Context, key *datastore.Key) error {
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		entity := newExportEntity(c, key.Kind())
+		if err := datastore.Get(c, key, entity); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, key, entity)
+		return err
+	}, nil)
+}
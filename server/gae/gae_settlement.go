@@ -0,0 +1,71 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+)
+
+// Function settleTransaction retires an active transaction outside of the regular
+// retirement, which only knows about success and failure. Of the price blocked on the
+// buyer's account, sellerShare is credited to the seller and the rest is reimbursed
+// to the buyer. The fee is charged in proportion to the seller's share. Returns the
+// fee charged.
+func settleTransaction(dao AccountingDao, txKey string, tx *Transaction, sellerShare money.Money, now time.Time) (money.Money, error) {
+	if tx.State != StateActive {
+		return money.Money{}, ErrTransactionAlreadyRetired
+	}
+	if sellerShare.Amount < 0 || sellerShare.Amount > tx.Price.Amount {
+		return money.Money{}, fmt.Errorf("Seller's share must be between 0 and %v", tx.Price)
+	}
+
+	shareFee := tx.Fee
+	shareFee.Amount = 0
+	if tx.Price.Amount != 0 {
+		shareFee.Amount = scaleAmount(tx.Fee.Amount, sellerShare.Amount, tx.Price.Amount)
+	}
+
+	zero := money.Money{Currency: tx.Price.Currency}
+	if sellerShare.Amount != 0 {
+		if err := PlaceAccountMovement(dao, now, AccountMovementTransactionFinish,
+			tx.Seller, tx.Buyer,
+			sellerShare, sellerShare.Add(shareFee).Neg(),
+			shareFee, zero,
+			nil, &txKey, nil, nil); err != nil {
+			return money.Money{}, err
+		}
+	}
+
+	// Whatever remains goes back to the buyer
+	rest := tx.Price.Add(tx.Fee).Sub(sellerShare).Sub(shareFee)
+	if rest.Amount != 0 {
+		if err := PlaceAccountMovement(dao, now, AccountMovementTransactionReimburse,
+			tx.Buyer, tx.Buyer,
+			rest, rest.Neg(),
+			zero, zero,
+			nil, &txKey, nil, nil); err != nil {
+			return money.Money{}, err
+		}
+	}
+
+	tx.State = StateRetired
+	return shareFee, nil
+}
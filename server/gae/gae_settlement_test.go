@@ -0,0 +1,160 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+)
+
+// An AccountingDao keeping accounts and movements in memory
+type memoryDao struct {
+	accounts  map[string]ParticipantAccount
+	movements map[string]AccountMovement
+	keys      int
+}
+
+func newMemoryDao() *memoryDao {
+	return &memoryDao{make(map[string]ParticipantAccount), make(map[string]AccountMovement), 0}
+}
+
+func (dao *memoryDao) GetAccount(participant string) (ParticipantAccount, error) {
+	if account, ok := dao.accounts[participant]; ok {
+		return account, nil
+	}
+	return ParticipantAccount{}, ErrNoSuchObject
+}
+
+func (dao *memoryDao) SaveAccount(account *ParticipantAccount) error {
+	dao.accounts[account.Participant] = *account
+	return nil
+}
+
+func (dao *memoryDao) GetMovement(key string) (AccountMovement, error) {
+	if movement, ok := dao.movements[key]; ok {
+		return movement, nil
+	}
+	return AccountMovement{}, ErrNoSuchObject
+}
+
+func (dao *memoryDao) SaveMovement(movement *AccountMovement) error {
+	dao.movements[*movement.Key] = *movement
+	return nil
+}
+
+func (dao *memoryDao) NewAccountMovementKey(participant string) (string, error) {
+	dao.keys++
+	return fmt.Sprintf("%v-%v", participant, dao.keys), nil
+}
+
+func (dao *memoryDao) GetDeposit(uid string) (Deposit, error) {
+	return Deposit{}, ErrNoSuchObject
+}
+
+func (dao *memoryDao) SaveDeposit(uid string, deposit *Deposit) error {
+	return nil
+}
+
+// Settling must book what Transaction.Retire books when the seller gets the whole
+// price (a successful transaction) or nothing (a failed one): Price and fee are
+// unblocked on the buyer's account, the seller receives the price and the fee leaves
+// the system, or the buyer is reimbursed both. Splits lie in between.
+func TestSettleTransaction(t *testing.T) {
+	const buyer, seller = "buyer", "seller"
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	btc := func(amount int64) money.Money { return money.Money{Currency: money.BTC, Amount: amount} }
+
+	for _, c := range []struct {
+		name                                        string
+		sellerShare                                 int64
+		buyerAvailable, sellerAvailable, chargedFee int64
+		movements                                   int
+	}{
+		{"like successful retirement", 1000, 0, 1000, 30, 1},
+		{"like failed retirement", 0, 1030, 0, 0, 1},
+		{"split", 400, 618, 400, 12, 2},
+	} {
+		dao := newMemoryDao()
+		// As booked when the transaction was created: price and fee blocked
+		dao.accounts[buyer] = ParticipantAccount{Participant: buyer, Currency: money.BTC,
+			AvailableAmount: 0, BlockedAmount: 1030}
+		tx := &Transaction{Buyer: buyer, Seller: seller, Price: btc(1000), Fee: btc(30), State: StateActive}
+
+		cached := NewCachedAccountingDao(dao, true)
+		fee, err := settleTransaction(cached, "tx", tx, btc(c.sellerShare), now)
+		if err == nil {
+			err = cached.Flush()
+		}
+		if err != nil {
+			t.Errorf("%v: Settling failed: %v", c.name, err)
+			continue
+		}
+
+		b, s := dao.accounts[buyer], dao.accounts[seller]
+		if b.BlockedAmount != 0 || b.AvailableAmount != c.buyerAvailable {
+			t.Errorf("%v: Expected buyer to have %v available and nothing blocked, got %v and %v",
+				c.name, c.buyerAvailable, b.AvailableAmount, b.BlockedAmount)
+		}
+		if s.AvailableAmount != c.sellerAvailable || s.BlockedAmount != 0 {
+			t.Errorf("%v: Expected seller to have %v available, got %v (%v blocked)",
+				c.name, c.sellerAvailable, s.AvailableAmount, s.BlockedAmount)
+		}
+		if fee.Amount != c.chargedFee {
+			t.Errorf("%v: Expected fee %v, got %v", c.name, c.chargedFee, fee.Amount)
+		}
+		if total := b.AvailableAmount + s.AvailableAmount + fee.Amount; total != 1030 {
+			t.Errorf("%v: Expected price and fee to be distributed, got %v in total", c.name, total)
+		}
+		if tx.State != StateRetired {
+			t.Errorf("%v: Expected transaction to be retired", c.name)
+		}
+		if len(dao.movements) != c.movements {
+			t.Errorf("%v: Expected %v movements, got %v", c.name, c.movements, len(dao.movements))
+		}
+
+		// Both accounts' ledgers must end in the movements just booked
+		for _, account := range []ParticipantAccount{b, s} {
+			if account.LastMovementKey == nil {
+				continue
+			}
+			if m, err := dao.GetMovement(*account.LastMovementKey); err != nil {
+				t.Errorf("%v: Ledger of %v ends in unknown movement", c.name, account.Participant)
+			} else if m.TxKey == nil || *m.TxKey != "tx" {
+				t.Errorf("%v: Ledger of %v ends in unrelated movement %v", c.name, account.Participant, m)
+			}
+		}
+
+		if _, err := settleTransaction(dao, "tx", tx, btc(c.sellerShare), now); err != ErrTransactionAlreadyRetired {
+			t.Errorf("%v: Expected settling twice to fail, got: %v", c.name, err)
+		}
+	}
+
+	tx := &Transaction{Buyer: buyer, Seller: seller, Price: btc(1000), Fee: btc(30), State: StateActive}
+	if _, err := settleTransaction(newMemoryDao(), "tx", tx, btc(1001), now); err == nil {
+		t.Errorf("Expected a seller's share above the price to be refused")
+	}
+
+	// Movements are checked like any other: Money that isn't blocked can't be paid out
+	dao := NewCachedAccountingDao(newMemoryDao(), true)
+	if _, err := settleTransaction(dao, "tx", tx, btc(400), now); err == nil {
+		t.Errorf("Expected settling without blocked funds to fail")
+	}
+}
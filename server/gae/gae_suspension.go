@@ -0,0 +1,408 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// What happens to a suspended participant's active transactions
+type SuspensionPolicy string
+
+const (
+	SuspensionFinish SuspensionPolicy = "finish" // Transactions run to completion
+	SuspensionRefund SuspensionPolicy = "refund" // Transactions are retired, the buyer is refunded
+)
+
+func ParseSuspensionPolicy(s string) (SuspensionPolicy, error) {
+	switch policy := SuspensionPolicy(s); policy {
+	case SuspensionFinish, SuspensionRefund:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Unknown suspension policy: %#v", s)
+	}
+}
+
+// Actions recorded in the audit log
+const (
+	AuditSuspend     = "suspend"
+	AuditLift        = "lift"
+	AuditWithdrawBid = "withdraw-bid"
+	AuditRefundTx    = "refund-tx"
+)
+
+// Maximum number of entries returned by queries for suspensions and the audit log
+const maxAuditQueryResults = 1000
+
+// A suspension of a participant, as ordered by the admin. While it is in force,
+// the participant's bids are refused.
+type Suspension struct {
+	Participant string           `datastore:"-"`
+	Reason      string           `datastore:",noindex"`
+	Policy      SuspensionPolicy `datastore:",noindex"`
+	Since       time.Time        `datastore:",noindex"`
+	Until       time.Time        `datastore:",noindex"` // Zero if suspended indefinitely
+	Document    string           `datastore:",noindex"`
+	Signature   string           `datastore:",noindex"`
+}
+
+// Returns whether the suspension is in force at the given time.
+func (s *Suspension) InForce(now time.Time) bool {
+	return s.Until.IsZero() || now.Before(s.Until)
+}
+
+// An entry of the audit log, which records every action taken against a participant.
+type AuditEntry struct {
+	Time        time.Time
+	Action      string `datastore:",noindex"`
+	Participant string
+	Subject     string `datastore:",noindex"` // The bid or transaction concerned, if any
+	Details     string `datastore:",noindex"`
+	Document    string `datastore:",noindex"` // The admin's signed request
+	Signature   string `datastore:",noindex"`
+}
+
+func SuspensionKey(c context.Context, participant string) *datastore.Key {
+	return datastore.NewKey(c, "Suspension", participant, 0, nil)
+}
+
+func addAuditEntry(c context.Context, entry *AuditEntry) error {
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "AuditEntry", nil), entry)
+	return err
+}
+
+// Returns the suspension of the participant, or nil if none is in force.
+func GetSuspension(c context.Context, participant string, now time.Time) (*Suspension, error) {
+	var suspension Suspension
+	if err := datastore.Get(c, SuspensionKey(c, participant), &suspension); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !suspension.InForce(now) {
+		return nil, nil
+	}
+	suspension.Participant = participant
+	return &suspension, nil
+}
+
+// Suspends a participant, or replaces the participant's suspension, and records
+// this in the audit log.
+func Suspend(c context.Context, suspension *Suspension) error {
+	f := func(c context.Context) error {
+		if _, err := datastore.Put(c, SuspensionKey(c, suspension.Participant), suspension); err != nil {
+			return err
+		}
+		details := fmt.Sprintf("policy=%v reason=%v", suspension.Policy, suspension.Reason)
+		if !suspension.Until.IsZero() {
+			details += " until=" + suspension.Until.Format(time.RFC3339)
+		}
+		return addAuditEntry(c, &AuditEntry{
+			Time:        suspension.Since,
+			Action:      AuditSuspend,
+			Participant: suspension.Participant,
+			Details:     details,
+			Document:    suspension.Document,
+			Signature:   suspension.Signature,
+		})
+	}
+	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+}
+
+// Lifts a participant's suspension and records this in the audit log.
+func LiftSuspension(c context.Context, participant string, now time.Time, document, signature string) error {
+	f := func(c context.Context) error {
+		if err := datastore.Delete(c, SuspensionKey(c, participant)); err != nil {
+			return err
+		}
+		return addAuditEntry(c, &AuditEntry{
+			Time:        now,
+			Action:      AuditLift,
+			Participant: participant,
+			Document:    document,
+			Signature:   signature,
+		})
+	}
+	return datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true})
+}
+
+// Returns all suspensions, including expired ones.
+func QuerySuspensions(c context.Context) ([]Suspension, error) {
+	suspensions := make([]Suspension, 0, 8)
+	keys, err := datastore.NewQuery("Suspension").Limit(maxAuditQueryResults).GetAll(c, &suspensions)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		suspensions[i].Participant = key.StringID()
+	}
+	return suspensions, nil
+}
+
+// Returns the most recent entries of the audit log, optionally restricted to a participant.
+func QueryAuditLog(c context.Context, participant string, limit int) ([]AuditEntry, error) {
+	if limit > maxAuditQueryResults {
+		limit = maxAuditQueryResults
+	}
+	query := datastore.NewQuery("AuditEntry").Order("-Time").Limit(limit)
+	if participant != "" {
+		query = query.Filter("Participant =", participant)
+	}
+	entries := make([]AuditEntry, 0, limit)
+	if _, err := query.GetAll(c, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Withdraws all bids of a participant that haven't been matched yet, so they take
+// no further part in matching. Returns the number of bids withdrawn. Bids stored before
+// their Participant and State were indexed are only found after ReindexEntities has run.
+// The matcher withdraws them anyway (see withdrawIfSuspended).
+func WithdrawBids(c context.Context, participant string, now time.Time, document, signature string) (int, error) {
+	count := 0
+	for _, state := range []BidState{InQueue, Placed} {
+		iter := datastore.NewQuery("Bid").
+			Filter("Participant =", participant).
+			Filter("State =", int64(state)).
+			KeysOnly().Run(c)
+		for {
+			key, err := iter.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return count, err
+			}
+			if withdrawn, err := withdrawBid(c, key, now, document, signature); err != nil {
+				return count, err
+			} else if withdrawn {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// Suspensions looked up during one run of the matcher, by participant
+type suspensionCache struct {
+	now       time.Time
+	suspended map[string]bool
+}
+
+func newSuspensionCache(now time.Time) *suspensionCache {
+	return &suspensionCache{now, make(map[string]bool)}
+}
+
+// Withdraws a hot bid if its participant is suspended. Hot bids stored by older
+// versions don't know their participant, so the bid is consulted. Returns whether
+// the bid has been withdrawn, in which case it must not be matched.
+func (cache *suspensionCache) withdrawIfSuspended(c context.Context, hot *hotBid) (bool, error) {
+	participant := hot.Participant
+	if participant == "" {
+		var bid Bid
+		if err := datastore.Get(c, hot.BidKey, bidCodec{&bid, nil}); err != nil {
+			return false, err
+		}
+		participant = bid.Participant
+	}
+
+	suspended, ok := cache.suspended[participant]
+	if !ok {
+		if suspension, err := GetSuspension(c, participant, cache.now); err != nil {
+			return false, err
+		} else {
+			suspended = suspension != nil
+			cache.suspended[participant] = suspended
+		}
+	}
+	if !suspended {
+		return false, nil
+	}
+
+	log.Infof(c, "Not matching bid %v of suspended participant %v", hot.BidKey, participant)
+	_, err := withdrawBid(c, hot.BidKey, cache.now, "", "")
+	return true, err
+}
+
+func withdrawBid(c context.Context, key *datastore.Key, now time.Time, document, signature string) (bool, error) {
+	var withdrawn *Bid
+	f := func(c context.Context) error {
+		withdrawn = nil
+		var bid Bid
+		var ext BidExtension
+		if err := datastore.Get(c, key, bidCodec{&bid, &ext}); err != nil {
+			return err
+		}
+		if bid.State != InQueue && bid.State != Placed {
+			return nil
+		}
+
+		if err := deleteHotBid(c, key, &bid); err != nil {
+			return err
+		}
+		if err := releaseBidRequest(c, key, &bid, &ext); err != nil {
+			return err
+		}
+
+		// Retire the bid as if it had expired just now
+		dao := NewGaeAccountingDao(c, true)
+		bid.Expires = now
+		if err := retireBid(c, dao, key, &bid, &ext, now); err != nil {
+			return err
+		}
+
+		if err := addAuditEntry(c, &AuditEntry{
+			Time:        now,
+			Action:      AuditWithdrawBid,
+			Participant: bid.Participant,
+			Subject:     key.Encode(),
+			Document:    document,
+			Signature:   signature,
+		}); err != nil {
+			return err
+		}
+
+		withdrawn = &bid
+		return dao.Flush()
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return false, err
+	}
+	if withdrawn != nil {
+		log.Infof(c, "Withdrew bid %v of %v", key, withdrawn.Participant)
+	}
+	return withdrawn != nil, nil
+}
+
+// Removes a bid from its hot zone, where it waits for being matched. Must be called
+// inside a transaction.
+func deleteHotBid(c context.Context, key *datastore.Key, bid *Bid) error {
+	iter := datastore.NewQuery("HotBid").Ancestor(hotZoneKey(c, bid.MatchKey())).Run(c)
+	for {
+		var hot hotBid
+		if hotKey, err := iter.Next(hotBidCodec{&hot}); err == datastore.Done {
+			return nil
+		} else if err != nil {
+			return err
+		} else if hot.BidKey.Equal(key) {
+			return datastore.Delete(c, hotKey)
+		}
+	}
+}
+
+// Retires all active transactions of a participant, as buyer or seller, refunding
+// the buyers. Returns the number of transactions refunded. Transactions stored before
+// their Buyer, Seller and State were indexed are only found after ReindexEntities has run.
+func RefundTransactions(c context.Context, participant string, now time.Time, document, signature string) (int, error) {
+	count := 0
+	for _, role := range []string{"Buyer", "Seller"} {
+		iter := datastore.NewQuery("Tx").
+			Filter(role+" =", participant).
+			Filter("State =", int64(StateActive)).
+			KeysOnly().Run(c)
+		for {
+			key, err := iter.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return count, err
+			}
+			if refunded, err := refundTransaction(c, key, participant, now, document, signature); err != nil {
+				return count, err
+			} else if refunded {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func refundTransaction(c context.Context, txKey *datastore.Key, participant string, now time.Time, document, signature string) (bool, error) {
+	var retired *Transaction
+	f := func(c context.Context) error {
+		retired = nil
+		tx, ext, err := GetTransaction(c, txKey)
+		if err != nil {
+			return err
+		}
+		if tx.State != StateActive {
+			return nil
+		}
+
+		dao := NewGaeAccountingDao(c, true)
+		nothing := money.Money{Currency: tx.Price.Currency}
+		if _, err := settleTransaction(dao, txKey.Encode(), tx, nothing, now); err != nil {
+			return err
+		}
+		ext.Retired = now
+		if err := addAggregatePriceTask(c, txKey.Encode(), tx); err != nil {
+			return err
+		}
+		if ext.Dispute == DisputeOpen {
+			ext.Dispute = DisputeSettled
+			ext.SellerShare = nothing
+		}
+		tx.Revision++
+
+		// The admin is neither buyer nor seller. The audit entry below keeps the admin's
+		// signed request.
+		message := Tmessage{
+			Received:  now,
+			From:      FromUnknown,
+			Document:  document,
+			Signature: signature,
+			Accepted:  true,
+			PrePhase:  tx.Phase,
+			PostPhase: tx.Phase,
+		}
+		if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Tmessage", txKey), &message); err != nil {
+			return err
+		}
+
+		if _, err := datastore.Put(c, txKey, datastore.PropertyLoadSaver(txCodec{tx, ext})); err != nil {
+			return err
+		}
+
+		if err := addAuditEntry(c, &AuditEntry{
+			Time:        now,
+			Action:      AuditRefundTx,
+			Participant: participant,
+			Subject:     txKey.Encode(),
+			Details:     fmt.Sprintf("refunded %v to %v", tx.Price.Add(tx.Fee), tx.Buyer),
+			Document:    document,
+			Signature:   signature,
+		}); err != nil {
+			return err
+		}
+
+		retired = tx
+		return dao.Flush()
+	}
+
+	if err := datastore.RunInTransaction(c, f, &datastore.TransactionOptions{XG: true}); err != nil {
+		return false, err
+	}
+	countRetiredTransaction(retired)
+	return retired != nil, nil
+}
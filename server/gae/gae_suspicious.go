@@ -0,0 +1,188 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Reasons for flagging a pair of participants as suspicious
+const (
+	SuspicionSameParty      = "same_party"       // Buyer and seller are the same participant or team
+	SuspicionSameRemoteAddr = "same_remote_addr" // Both bids' nonces were issued to the same address
+	SuspicionWorkerHost     = "worker_host"      // The seller's worker runs on the buyer's host
+)
+
+// Transactions are scanned only after this delay, so that the seller's worker URL is known.
+const suspicionScanDelay = 1 * time.Hour
+
+// Maximum number of transactions scanned per run of the detector
+const suspicionScanBatchSize = 200
+
+// A pair of buyer and seller whose transactions look like wash trades. Pairs are
+// flagged for review by the admin, but nothing is done about them automatically.
+type SuspiciousPair struct {
+	Buyer     string    `datastore:",noindex"`
+	Seller    string    `datastore:",noindex"`
+	Reasons   []string  `datastore:",noindex"`
+	Count     int       `datastore:",noindex"` // Number of suspicious transactions
+	FirstSeen time.Time `datastore:",noindex"`
+	LastSeen  time.Time
+	LastTx    string `datastore:",noindex"` // The most recent suspicious transaction
+}
+
+// Remembers up to which point in time transactions have been scanned.
+type suspicionScan struct {
+	ScannedUntil time.Time
+}
+
+func suspiciousPairKey(c context.Context, buyer, seller string) *datastore.Key {
+	return datastore.NewKey(c, "SuspiciousPair", buyer+"/"+seller, 0, nil)
+}
+
+func suspicionScanKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "SuspicionScan", "scan", 0, nil)
+}
+
+// Scans the transactions matched since the last run for signs of wash trading and
+// flags the pairs of participants involved. Returns the number of transactions flagged.
+func DetectSuspiciousPairs(c context.Context, now time.Time) (int, error) {
+	var scan suspicionScan
+	if err := datastore.Get(c, suspicionScanKey(c), &scan); err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+	until := now.Add(-suspicionScanDelay)
+
+	query := datastore.NewQuery("Tx").
+		Filter("Matched >", scan.ScannedUntil).
+		Filter("Matched <=", until).
+		Order("Matched").
+		Limit(suspicionScanBatchSize)
+	iter := query.Run(c)
+
+	flagged, scanned := 0, 0
+	for {
+		var tx Transaction
+		var ext TxExtension
+		if key, err := iter.Next(txCodec{&tx, &ext}); err == datastore.Done {
+			break
+		} else if err != nil {
+			return flagged, err
+		} else if reasons, err := suspicionReasons(c, &tx); err != nil {
+			return flagged, err
+		} else if len(reasons) > 0 {
+			if err := flagSuspiciousPair(c, key.Encode(), &tx, reasons); err != nil {
+				return flagged, err
+			}
+			flagged++
+		}
+		scanned++
+		scan.ScannedUntil = tx.Matched
+	}
+
+	// If the batch wasn't full, everything up to the scan's end has been seen
+	if scanned < suspicionScanBatchSize {
+		scan.ScannedUntil = until
+	}
+	if _, err := datastore.Put(c, suspicionScanKey(c), &scan); err != nil {
+		return flagged, err
+	}
+	log.Infof(c, "Scanned %v transactions up to %v, %v of them suspicious", scanned, scan.ScannedUntil, flagged)
+	return flagged, nil
+}
+
+// Returns the reasons why a transaction looks like a wash trade, if any.
+func suspicionReasons(c context.Context, tx *Transaction) ([]string, error) {
+	buyerBid, buyerExt, err := GetBid(c, tx.BuyerBid)
+	if err != nil {
+		return nil, err
+	}
+	sellerBid, sellerExt, err := GetBid(c, tx.SellerBid)
+	if err != nil {
+		return nil, err
+	}
+
+	reasons := make([]string, 0, 3)
+	if selfDealing(buyerBid.Participant, buyerExt.Signer, sellerBid.Participant, sellerExt.Signer) {
+		reasons = append(reasons, SuspicionSameParty)
+	}
+	buyerHost := remoteHost(buyerExt.RemoteAddr)
+	if buyerHost != "" && buyerHost == remoteHost(sellerExt.RemoteAddr) {
+		reasons = append(reasons, SuspicionSameRemoteAddr)
+	}
+	if buyerHost != "" && tx.WorkerURL != nil {
+		if u, err := url.Parse(*tx.WorkerURL); err == nil && u.Hostname() == buyerHost {
+			reasons = append(reasons, SuspicionWorkerHost)
+		}
+	}
+	return reasons, nil
+}
+
+// Strips the port, if any, from a network address.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func flagSuspiciousPair(c context.Context, txId string, tx *Transaction, reasons []string) error {
+	key := suspiciousPairKey(c, tx.Buyer, tx.Seller)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		var pair SuspiciousPair
+		if err := datastore.Get(c, key, &pair); err == datastore.ErrNoSuchEntity {
+			pair = SuspiciousPair{Buyer: tx.Buyer, Seller: tx.Seller, FirstSeen: tx.Matched}
+		} else if err != nil {
+			return err
+		}
+		for _, reason := range reasons {
+			if !containsReason(pair.Reasons, reason) {
+				pair.Reasons = append(pair.Reasons, reason)
+			}
+		}
+		pair.Count++
+		pair.LastSeen = tx.Matched
+		pair.LastTx = txId
+		_, err := datastore.Put(c, key, &pair)
+		return err
+	}, nil)
+}
+
+func containsReason(reasons []string, reason string) bool {
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the pairs flagged as suspicious, most recently seen first.
+func QuerySuspiciousPairs(c context.Context, limit int) ([]SuspiciousPair, error) {
+	pairs := make([]SuspiciousPair, 0, 16)
+	if _, err := datastore.NewQuery("SuspiciousPair").Order("-LastSeen").Limit(limit).GetAll(c, &pairs); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
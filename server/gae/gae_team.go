@@ -0,0 +1,239 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gae
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"google.golang.org/appengine/datastore"
+)
+
+// A team allows an organization account to authorize member addresses to place bids
+// against the organization's balance. The member list is signed by the organization.
+type Team struct {
+	Organization        string
+	Members             []TeamMember
+	Document, Signature string
+	Updated             time.Time
+}
+
+// A member of a team, along with the member's spending limits and how much of them
+// has been used up.
+type TeamMember struct {
+	Address    string
+	DailyLimit money.Money // Maximum spend per day (UTC)
+	TotalLimit money.Money // Maximum spend over the member's lifetime in the team
+	Day        string      // The day SpentToday refers to, formatted as YYYY-MM-DD
+	SpentToday money.Money
+	SpentTotal money.Money
+}
+
+// The spending situation of a team member, as presented to users.
+type MemberBudget struct {
+	Address                string
+	DailyLimit, TotalLimit money.Money
+	SpentToday, SpentTotal money.Money
+	LeftToday, LeftTotal   money.Money
+}
+
+var ErrNoSuchTeam = fmt.Errorf("No such team")
+
+func TeamKey(c context.Context, organization string) *datastore.Key {
+	return datastore.NewKey(c, "Team", organization, 0, nil)
+}
+
+// Returns the team of the given organization, or ErrNoSuchTeam.
+func GetTeam(c context.Context, organization string) (*Team, error) {
+	team := &Team{Organization: organization}
+	if err := datastore.Get(c, TeamKey(c, organization), teamCodec{team}); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchTeam
+	} else if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// Stores a team, replacing the organization's previous member list. Members that
+// were part of the previous list keep what they have spent so far.
+func SaveTeam(c context.Context, team *Team) error {
+	f := func(c context.Context) error {
+		if old, err := GetTeam(c, team.Organization); err == ErrNoSuchTeam {
+			// First member list of this organization
+		} else if err != nil {
+			return err
+		} else {
+			for i := range team.Members {
+				if m := old.Member(team.Members[i].Address); m != nil {
+					team.Members[i].Day = m.Day
+					team.Members[i].SpentToday = m.SpentToday
+					team.Members[i].SpentTotal = m.SpentTotal
+				}
+			}
+		}
+
+		_, err := datastore.Put(c, TeamKey(c, team.Organization), teamCodec{team})
+		return err
+	}
+
+	return datastore.RunInTransaction(c, f, nil)
+}
+
+// Returns the member with the given address, or nil.
+func (team *Team) Member(address string) *TeamMember {
+	for i := range team.Members {
+		if team.Members[i].Address == address {
+			return &team.Members[i]
+		}
+	}
+	return nil
+}
+
+// Returns every member's budget as of the given time.
+func (team *Team) Budgets(now time.Time) []MemberBudget {
+	result := make([]MemberBudget, 0, len(team.Members))
+	for _, m := range team.Members {
+		m.rollOver(now)
+		b := MemberBudget{
+			Address:    m.Address,
+			DailyLimit: m.DailyLimit,
+			TotalLimit: m.TotalLimit,
+			SpentToday: m.SpentToday,
+			SpentTotal: m.SpentTotal,
+			LeftToday:  m.DailyLimit,
+			LeftTotal:  m.TotalLimit,
+		}
+		b.LeftToday.Amount = nonNegative(m.DailyLimit.Amount - m.SpentToday.Amount)
+		b.LeftTotal.Amount = nonNegative(m.TotalLimit.Amount - m.SpentTotal.Amount)
+		result = append(result, b)
+	}
+	return result
+}
+
+func teamDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Resets the daily spend if it refers to a day before now.
+func (m *TeamMember) rollOver(now time.Time) {
+	if day := teamDay(now); m.Day != day {
+		m.Day = day
+		m.SpentToday.Amount = 0
+	}
+}
+
+// Adds an amount to the member's spend, unless that would exceed one of the limits.
+func (m *TeamMember) spend(now time.Time, amount int64) error {
+	m.rollOver(now)
+	if m.SpentToday.Amount+amount > m.DailyLimit.Amount {
+		return fmt.Errorf("Daily spending limit of member %v exceeded", m.Address)
+	}
+	if m.SpentTotal.Amount+amount > m.TotalLimit.Amount {
+		return fmt.Errorf("Total spending limit of member %v exceeded", m.Address)
+	}
+	m.SpentToday.Amount += amount
+	m.SpentTotal.Amount += amount
+	return nil
+}
+
+// Takes back an amount spent at the given time.
+func (m *TeamMember) refund(spent time.Time, amount int64) {
+	if m.Day == teamDay(spent) {
+		m.SpentToday.Amount = nonNegative(m.SpentToday.Amount - amount)
+	}
+	m.SpentTotal.Amount = nonNegative(m.SpentTotal.Amount - amount)
+}
+
+func nonNegative(amount int64) int64 {
+	if amount < 0 {
+		return 0
+	}
+	return amount
+}
+
+// Returns the amount a bid counts against a member's spending limits: A buy's
+// price and fee. Sells don't spend anything.
+func bidSpend(bid *Bid) int64 {
+	if bid.Type == Buy {
+		return bid.Price.Amount + bid.Fee.Amount
+	}
+	return 0
+}
+
+// Charges a bid placed by a team member against the member's spending limits.
+// Must be called inside a transaction.
+func chargeTeamMember(c context.Context, bid *Bid, member string, now time.Time) error {
+	team, err := GetTeam(c, bid.Participant)
+	if err != nil {
+		return err
+	}
+
+	if m := team.Member(member); m == nil {
+		return &PermissionError{fmt.Sprintf("%v is not a member of team %v", member, team.Organization)}
+	} else if err := m.spend(now, bidSpend(bid)); err != nil {
+		return &InsufficientFundsError{err}
+	}
+
+	_, err = datastore.Put(c, TeamKey(c, team.Organization), teamCodec{team})
+	return err
+}
+
+// Gives back to a team member an amount charged for a bid: Everything if the bid
+// didn't get matched, or the part the price and fee of its transaction are lower
+// than the bid's. Must be called inside a transaction.
+func refundTeamMember(c context.Context, bid *Bid, member string, amount int64) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	team, err := GetTeam(c, bid.Participant)
+	if err == ErrNoSuchTeam {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if m := team.Member(member); m == nil {
+		// Member has been removed from the team in the meantime
+		return nil
+	} else {
+		m.refund(bid.Created, amount)
+	}
+
+	_, err = datastore.Put(c, TeamKey(c, team.Organization), teamCodec{team})
+	return err
+}
+
+// Returns the participant on whose behalf address may send messages to a transaction.
+// Usually, this is the address itself. The team member who signed one of the
+// transaction's bids acts on behalf of the team, though.
+func transactionSender(c context.Context, tx *Transaction, address string) (string, error) {
+	if address == tx.Buyer || address == tx.Seller {
+		return address, nil
+	}
+	for _, bidId := range []string{tx.BuyerBid, tx.SellerBid} {
+		if bid, ext, err := GetBid(c, bidId); err != nil {
+			return "", err
+		} else if ext.Signer == address {
+			return bid.Participant, nil
+		}
+	}
+	return address, nil
+}
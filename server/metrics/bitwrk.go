@@ -0,0 +1,47 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+// The metrics exported by the BitWrk server.
+var (
+	BidsEnqueued = NewCounter("bitwrk_bids_enqueued_total",
+		"Number of bids accepted into the matching queue.", "article", "type")
+	BidsMatched = NewCounter("bitwrk_bids_matched_total",
+		"Number of bids that became part of a transaction.", "article")
+	BidsExpired = NewCounter("bitwrk_bids_expired_total",
+		"Number of bids retired without having been matched.", "article")
+	MatchingDuration = NewHistogram("bitwrk_matching_batch_duration_seconds",
+		"Time spent matching one batch of incoming bids.", DurationBuckets, "matchkey")
+	TransactionsRetired = NewCounter("bitwrk_transactions_retired_total",
+		"Number of transactions retired, by the phase they ended in.", "article", "phase")
+	WorkerProbes = NewCounter("bitwrk_worker_probes_total",
+		"Number of announced worker URLs probed, by result (ok or failed).", "result")
+	NoncesIssued = NewCounter("bitwrk_nonces_issued_total",
+		"Number of nonces handed out to clients.")
+	NoncesRejected = NewCounter("bitwrk_nonces_rejected_total",
+		"Number of requests carrying an unknown or expired nonce.")
+	TaskFailures = NewCounter("bitwrk_queue_task_failures_total",
+		"Number of queue tasks that failed, by queue handler.", "task")
+	MatchesRefused = NewCounter("bitwrk_matches_refused_total",
+		"Number of bid pairs not matched because they must not trade with each other.")
+	LedgerMovements = NewCounter("bitwrk_ledger_movements_total",
+		"Number of account movements written. Retried datastore transactions are counted again.",
+		"currency")
+	LedgerVolume = NewCounter("bitwrk_ledger_movement_volume_total",
+		"Sum of the absolute available balance changes of account movements, in the currency's smallest unit.",
+		"currency")
+)
@@ -0,0 +1,290 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics collects counters and histograms and renders them in the Prometheus
+// text format. Each instance only keeps the increments it hasn't handed on yet (see
+// TakePending), so that totals can be kept in shared storage and add up across
+// instances.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anything that can write its samples in the text format.
+type collector interface {
+	name() string
+	write(w io.Writer, series map[string]map[string]float64)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]collector)
+)
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[c.name()]; ok {
+		panic("metric registered twice: " + c.name())
+	}
+	registry[c.name()] = c
+}
+
+// Increments collected since they were last taken, by series. A series is identified
+// by the metric's name, the part of the metric (for histograms), an optional bucket
+// bound and the label values, separated by zero bytes.
+var (
+	pendingMutex sync.Mutex
+	pending      = make(map[string]float64)
+	lastTaken    time.Time
+)
+
+func seriesKey(metricName, part, bound, labelKey string) string {
+	return metricName + "\x00" + part + "\x00" + bound + "\x00" + labelKey
+}
+
+func addPending(series string, v float64) {
+	pendingMutex.Lock()
+	pending[series] += v
+	pendingMutex.Unlock()
+}
+
+// Returns the increments collected since the last call and starts collecting anew.
+// The result maps opaque series keys to values and may be summed up with the results
+// of other calls and other instances, then be rendered using WriteText.
+func TakePending() map[string]float64 {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	result := pending
+	pending = make(map[string]float64)
+	lastTaken = time.Now()
+	return result
+}
+
+// Adds increments returned by TakePending back, e.g. because they couldn't be stored.
+func Requeue(increments map[string]float64) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	for series, v := range increments {
+		pending[series] += v
+	}
+}
+
+// Returns whether there are increments pending that haven't been taken for at least
+// the given interval.
+func Due(now time.Time, interval time.Duration) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	return len(pending) > 0 && !now.Before(lastTaken.Add(interval))
+}
+
+// Common part of counters and histograms: name, help text and label names.
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.metricName, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.metricName, typ)
+}
+
+// Returns the key under which the series with the given label values is stored.
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %v expects %v label values, got %v",
+			d.metricName, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// Formats the labels of a series, e.g. {article="foo",type="Buy"}. Additional label
+// pairs (as used by histogram buckets) are appended.
+func (d *desc) formatLabels(key string, extra ...string) string {
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, d.labels[i]+"="+quoteLabel(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Returns the label keys of the given series, sorted.
+func sortedLabelKeys(series map[string]float64) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func quoteLabel(value string) string {
+	return "\"" + labelEscaper.Replace(value) + "\""
+}
+
+// A monotonically increasing value, one per combination of label values.
+type Counter struct {
+	desc
+}
+
+// Creates and registers a new counter. By convention, the name ends with "_total".
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc{name, help, labels}}
+	register(c)
+	return c
+}
+
+// Increments the counter for the given label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Increments the counter for the given label values. Negative values are ignored.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	if v < 0 {
+		return
+	}
+	addPending(seriesKey(c.metricName, "", "", key), v)
+}
+
+func (c *Counter) write(w io.Writer, series map[string]map[string]float64) {
+	c.writeHeader(w, "counter")
+	values := series[""]
+	for _, k := range sortedLabelKeys(values) {
+		fmt.Fprintf(w, "%v%v %v\n", c.metricName, c.formatLabels(k), formatValue(values[k]))
+	}
+}
+
+// Bucket bounds suitable for durations measured in seconds.
+var DurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counts observations in buckets, one set of buckets per combination of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+}
+
+// Creates and registers a new histogram with the given (ascending) bucket upper bounds.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("histogram buckets must be sorted: " + name)
+	}
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: buckets,
+	}
+	register(h)
+	return h
+}
+
+// Records an observation for the given label values. Buckets are counted cumulatively,
+// so an observation is added to every bucket whose bound it doesn't exceed.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	for i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets); i++ {
+		addPending(seriesKey(h.metricName, "bucket", formatValue(h.buckets[i]), key), 1)
+	}
+	addPending(seriesKey(h.metricName, "sum", "", key), v)
+	addPending(seriesKey(h.metricName, "count", "", key), 1)
+}
+
+func (h *Histogram) write(w io.Writer, series map[string]map[string]float64) {
+	h.writeHeader(w, "histogram")
+	counts, sums := series["count"], series["sum"]
+	for _, k := range sortedLabelKeys(counts) {
+		for _, bound := range h.buckets {
+			le := formatValue(bound)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, h.formatLabels(k, "le", le),
+				formatValue(series["bucket\x00"+le][k]))
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, h.formatLabels(k, "le", "+Inf"), formatValue(counts[k]))
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.metricName, h.formatLabels(k), formatValue(sums[k]))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.metricName, h.formatLabels(k), formatValue(counts[k]))
+	}
+}
+
+// Writes all registered metrics in the Prometheus text format, ordered by name, using
+// the given totals as returned (and possibly summed up) by TakePending. Totals of
+// series no longer known are skipped.
+func WriteText(w io.Writer, totals map[string]float64) error {
+	registryMutex.Lock()
+	collectors := make([]collector, 0, len(registry))
+	for _, c := range registry {
+		collectors = append(collectors, c)
+	}
+	registryMutex.Unlock()
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+
+	// Group totals by metric name, then by part and bucket bound, then by label values
+	byMetric := make(map[string]map[string]map[string]float64)
+	for key, v := range totals {
+		parts := strings.SplitN(key, "\x00", 4)
+		if len(parts) != 4 {
+			continue
+		}
+		series := byMetric[parts[0]]
+		if series == nil {
+			series = make(map[string]map[string]float64)
+			byMetric[parts[0]] = series
+		}
+		part := parts[1]
+		if parts[2] != "" {
+			part += "\x00" + parts[2]
+		}
+		if series[part] == nil {
+			series[part] = make(map[string]float64)
+		}
+		series[part][parts[3]] += v
+	}
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf, byMetric[c.name()])
+	}
+	return buf.Flush()
+}
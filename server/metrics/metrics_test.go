@@ -0,0 +1,84 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Requests handled.", "path")
+	counter.Inc("/bid")
+	counter.Add(2, "/bid")
+	counter.Inc("/say \"hi\"\n")
+	counter.Add(-1, "/bid")
+
+	histogram := NewHistogram("test_duration_seconds", "Request duration.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	// Increments taken from different instances add up
+	totals := TakePending()
+	histogram.Observe(0.5)
+	for series, v := range TakePending() {
+		totals[series] += v
+	}
+	if len(TakePending()) != 0 {
+		t.Errorf("Expected no more increments to be pending")
+	}
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf, totals); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	text := buf.String()
+
+	for _, expected := range []string{
+		"# HELP test_requests_total Requests handled.\n# TYPE test_requests_total counter\n",
+		"test_requests_total{path=\"/bid\"} 3\n",
+		"test_requests_total{path=\"/say \\\"hi\\\"\\n\"} 1\n",
+		"# TYPE test_duration_seconds histogram\n",
+		"test_duration_seconds_bucket{le=\"0.1\"} 2\n",
+		"test_duration_seconds_bucket{le=\"1\"} 4\n",
+		"test_duration_seconds_bucket{le=\"+Inf\"} 5\n",
+		"test_duration_seconds_sum 4.15\n",
+		"test_duration_seconds_count 5\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Expected output to contain %#v, got:\n%v", expected, text)
+		}
+	}
+
+	// Metrics are ordered by name
+	if strings.Index(text, "test_duration_seconds") > strings.Index(text, "test_requests_total") {
+		t.Errorf("Metrics not sorted:\n%v", text)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	counter := NewCounter("test_labels_total", "Labels.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic when passing the wrong number of label values")
+		}
+	}()
+	counter.Inc("only one")
+}
@@ -0,0 +1,188 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// Fee revenue from transactions of one fee role
+type feeRevenue struct {
+	Count   int         `json:"count"`   // Number of transactions matched in the period
+	Charged json.Number `json:"charged"` // Sum of fees charged on retirement
+	Pending json.Number `json:"pending"` // Sum of fees of transactions not retired yet
+}
+
+type feeAccumulator struct {
+	count            int
+	charged, pending money.Money
+}
+
+func (a *feeAccumulator) add(tx *bitwrk.Transaction, ext *db.TxExtension) {
+	a.count++
+	if tx.State == bitwrk.StateActive {
+		a.pending = a.pending.Add(tx.Fee)
+	} else {
+		a.charged = a.charged.Add(db.ChargedFee(tx, ext))
+	}
+}
+
+func (a *feeAccumulator) revenue(unit money.Unit) feeRevenue {
+	return feeRevenue{
+		Count:   a.count,
+		Charged: json.Number(a.charged.Format(unit, false)),
+		Pending: json.Number(a.pending.Format(unit, false)),
+	}
+}
+
+// Reports the fees charged on an article's transactions within a period, by fee role.
+// Transactions created before the introduction of maker and taker fees are reported
+// with role "none", and are assumed to have been charged their full fee if they were
+// successful. Also reports the fee account's balance. Admin-only.
+func HandleQueryFees(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !user.IsAdmin(c) {
+		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
+		return
+	}
+
+	limitStr := r.FormValue("limit")
+	var limit int
+	if limitStr == "" {
+		limit = 10000
+	} else if n, err := strconv.ParseUint(limitStr, 10, 14); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		limit = int(n)
+	}
+
+	articleStr := r.FormValue("article")
+	var article bitwrk.ArticleId
+	if articleStr == "" {
+		http.Error(w, "article argument missing", http.StatusNotFound)
+		return
+	} else if err := util.CheckArticle(c, articleStr); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else {
+		article = bitwrk.ArticleId(articleStr)
+	}
+
+	periodStr := r.FormValue("period")
+	if periodStr == "" {
+		periodStr = "1d"
+	} else if !resolutionExists(periodStr) {
+		http.Error(w, "period unknown", http.StatusNotFound)
+		return
+	}
+	period := resolutionByName(periodStr)
+
+	beginStr := r.FormValue("begin")
+	var begin time.Time
+	if beginStr == "" {
+		begin = time.Now().Add(-period.interval)
+	} else if t, err := time.Parse(time.RFC3339, beginStr); err != nil {
+		http.Error(w, "Invalid begin time", http.StatusNotFound)
+		return
+	} else {
+		begin = t
+	}
+	end := begin.Add(period.interval)
+
+	var unit money.Unit
+	if r.FormValue("unit") == "" {
+		unit = money.MustParseUnit("mBTC")
+	} else if u, err := money.ParseUnit(r.FormValue("unit")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else {
+		unit = u
+	}
+
+	zero := money.Money{Currency: unit.Currency}
+	byRole := map[db.FeeRole]*feeAccumulator{
+		db.FeeRoleMaker: {0, zero, zero},
+		db.FeeRoleTaker: {0, zero, zero},
+		"":              {0, zero, zero},
+	}
+	count := 0
+	handler := func(key string, tx bitwrk.Transaction, ext db.TxExtension) {
+		if acc, ok := byRole[ext.FeeRole]; ok {
+			acc.add(&tx, &ext)
+		}
+		count++
+	}
+	if err := db.QueryTransactions(c, limit, article, unit.Currency, begin, end, handler); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Errorf(c, "Error querying transactions: %v", err)
+		return
+	}
+
+	account, err := db.NewGaeAccountingDao(c, false).GetAccount(config.CfgFeeAccount)
+	if err == bitwrk.ErrNoSuchObject {
+		account = bitwrk.ParticipantAccount{Participant: config.CfgFeeAccount, Currency: unit.Currency}
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Errorf(c, "Error getting fee account: %v", err)
+		return
+	}
+	balance := money.Money{Currency: account.Currency, Amount: account.AvailableAmount}
+
+	result := struct {
+		Article    bitwrk.ArticleId `json:"article"`
+		Begin      string           `json:"begin"`
+		End        string           `json:"end"`
+		Unit       string           `json:"unit"`
+		Count      int              `json:"count"`
+		Truncated  bool             `json:"truncated"`
+		Maker      feeRevenue       `json:"maker"`
+		Taker      feeRevenue       `json:"taker"`
+		None       feeRevenue       `json:"none"`
+		FeeAccount string           `json:"fee_account"`
+		Balance    json.Number      `json:"balance"`
+	}{
+		article,
+		begin.Format(time.RFC3339),
+		end.Format(time.RFC3339),
+		unit.String(),
+		count,
+		count == limit,
+		byRole[db.FeeRoleMaker].revenue(unit),
+		byRole[db.FeeRoleTaker].revenue(unit),
+		byRole[""].revenue(unit),
+		config.CfgFeeAccount,
+		json.Number(balance.Format(unit, false)),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf(c, "Error encoding fee report: %v", err)
+	}
+}
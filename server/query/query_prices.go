@@ -19,6 +19,7 @@ package query
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -32,44 +33,22 @@ import (
 	"github.com/indyjo/bitwrk/server/util"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 	"google.golang.org/appengine/user"
 )
 
 type timeslot struct {
-	Begin time.Time   `json:"begin"`
-	End   time.Time   `json:"end"`
-	Sum   money.Money `json:"sum"`
-	Min   money.Money `json:"min"`
-	Max   money.Money `json:"max"`
-	Count int         `json:"count"`
-}
-
-// Adds a single price to the statistic
-func (s *timeslot) addPrice(price money.Money) {
-	if s.Count == 0 {
-		s.Sum, s.Min, s.Max = price, price, price
-	} else {
-		s.Sum = s.Sum.Add(price)
-		if price.Amount < s.Min.Amount {
-			s.Min.Amount = price.Amount
-		}
-		if price.Amount > s.Max.Amount {
-			s.Max.Amount = price.Amount
-		}
-	}
-	s.Count++
-}
-
-// Moves the window one position forward and clears accumulators
-func (s *timeslot) advance() {
-	interval := s.End.Sub(s.Begin)
-	s.Begin = s.End
-	s.End = s.End.Add(interval)
-	s.Count = 0
-	s.Sum.Amount = 0
-	s.Min.Amount = 0
-	s.Max.Amount = 0
+	Begin    time.Time   `json:"begin"`
+	End      time.Time   `json:"end"`
+	Sum      money.Money `json:"sum"`
+	Min      money.Money `json:"min"`
+	Max      money.Money `json:"max"`
+	Count    int         `json:"count"`
+	Open     money.Money `json:"open"`
+	Close    money.Money `json:"close"`
+	VWAP     money.Money `json:"vwap"` // Every trade is one unit of the article, so this is the mean price
+	Fees     money.Money `json:"fees"`
+	Finished int         `json:"finished"`
+	Failed   int         `json:"failed"`
 }
 
 type resolution struct {
@@ -77,23 +56,14 @@ type resolution struct {
 	interval time.Duration
 }
 
-func (a resolution) finerThan(b resolution) bool {
-	return a.interval < b.interval
-}
-
-var resolutions = []resolution{
-	{"1y", 9 * 42 * 24 * time.Hour},
-	{"6w", 42 * 24 * time.Hour},
-	{"1w", 7 * 24 * time.Hour},
-	{"1d", 24 * time.Hour},
-	{"6h", 6 * time.Hour},
-	{"1h", 1 * time.Hour},
-	{"12m", 12 * time.Minute},
-	{"3m", 3 * time.Minute},
-	{"30s", 30 * time.Second},
-	{"6s", 6 * time.Second},
-	{"1s", 1 * time.Second},
-}
+// The resolutions at which price statistics are kept, from coarsest to finest
+var resolutions = func() []resolution {
+	result := make([]resolution, len(db.PriceResolutions))
+	for idx, r := range db.PriceResolutions {
+		result[idx] = resolution{r.Name, r.Interval}
+	}
+	return result
+}()
 
 var resolutionsByName = func() map[string]int {
 	result := make(map[string]int)
@@ -112,38 +82,12 @@ func resolutionByName(name string) resolution {
 	return resolutions[resolutionsByName[name]]
 }
 
-func (r resolution) nextFiner() resolution {
-	return resolutions[resolutionsByName[r.name]+1]
-}
-
-func (r resolution) isFinest() bool {
-	return resolutionsByName[r.name] == len(resolutions)-1
-}
-
-func (r resolution) coarsestTileResolution() resolution {
-	idx := resolutionsByName[r.name] - 5
-	if idx < 0 {
-		idx = 0
-	}
-	return resolutions[idx]
-}
-
-func (r resolution) finestTileResolution() resolution {
-	idx := resolutionsByName[r.name] - 2
-	if idx < 0 {
-		idx = 0
-	}
-	return resolutions[idx]
-}
-
 // HandleQueryPrices handles requests for a list of price statistics.
 func HandleQueryPrices(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	c := appengine.NewContext(r)
 
-	needLogin := false
-
 	articleStr := r.FormValue("article")
 	var article bitwrk.ArticleId
 	if articleStr == "" {
@@ -174,9 +118,9 @@ func HandleQueryPrices(w http.ResponseWriter, r *http.Request) {
 	}
 	resolution := resolutionByName(resolutionStr)
 
-	if period.interval > 10000*resolution.interval {
-		// User requested a lot of data... restrict for now
-		needLogin = true
+	if period.interval > maxPriceSlots*resolution.interval {
+		http.Error(w, "resolution too fine for period", http.StatusBadRequest)
+		return
 	}
 
 	// If begin is not given, calculate from period
@@ -189,8 +133,6 @@ func HandleQueryPrices(w http.ResponseWriter, r *http.Request) {
 		return
 	} else {
 		begin = t
-		// Explicitly stating begin requires athentication for now
-		needLogin = true
 	}
 
 	unitStr := r.FormValue("unit")
@@ -199,37 +141,27 @@ func HandleQueryPrices(w http.ResponseWriter, r *http.Request) {
 		unit = money.MustParseUnit("mBTC")
 	} else if u, err := money.ParseUnit(unitStr); err != nil {
 		http.Error(w, "Invalid unit parameter", http.StatusNotFound)
+		return
 	} else {
 		unit = u
 	}
 
-	// Calculate end from begin and period
+	// Calculate end from begin and period, and align begin with the resolution's slots
 	end := begin.Add(period.interval)
+	begin = begin.Truncate(resolution.interval)
 
-	// Lookup coarsest tile resolution
-	tile := resolution.coarsestTileResolution()
-	if period.finerThan(tile) {
-		tile = period
-	}
-	if tile.finerThan(resolution.finestTileResolution()) {
-		tile = resolution.finestTileResolution()
-	}
-
-	// Truncate begin to a multiple of coarsest tile resolution.
-	begin = begin.Truncate(tile.interval)
-
-	// Enforce admin permissions if necessary
-	if needLogin && !user.IsAdmin(c) {
-		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
-		return
-	}
-
-	if prices, err := queryPrices(c, article, unit.Currency, tile, resolution, begin, end); err != nil {
+	if prices, err := queryPrices(c, article, unit.Currency, resolution, begin, end); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	} else if r.FormValue("format") == "flot" {
 		w.Header().Set("Content-Type", "application/json")
 		renderPricesForFlot(w, prices, unit)
+	} else if r.FormValue("format") == "ohlc" {
+		w.Header().Set("Content-Type", "application/json")
+		renderPricesAsOhlc(w, prices, unit)
+	} else if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		renderPricesAsCsv(w, prices, unit)
 	} else if data, err := json.Marshal(prices); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -268,113 +200,77 @@ func renderPricesForFlot(w io.Writer, slots []timeslot, unit money.Unit) {
 	fmt.Fprintf(w, "]\n")
 }
 
-// Returns prices for trades between 'begin' and 'end', in resolution 'res', recursing from tile size 'tile' down to the
-// most appropriate tile size, employing caching on the go.
-// Assumes that 'begin' is aligned with the current tile size.
-func queryPrices(c context.Context, article bitwrk.ArticleId, currency money.Currency, tile, res resolution, begin, end time.Time) ([]timeslot, error) {
-	finest := res.finestTileResolution()
-	if tile.finerThan(finest) {
-		panic("Tile size too small")
-	}
-
-	// Does the interval fit into a single tile? If no, fan out and don't cache.
-	if begin.Add(tile.interval).Before(end) {
-		result := make([]timeslot, 0)
-		count := 0
-		for begin.Before(end) {
-			tileEnd := begin.Add(tile.interval)
-			if tileEnd.After(end) {
-				tileEnd = end
-			}
-
-			if r, err := queryPrices(c, article, currency, tile, res, begin, tileEnd); err != nil {
-				return nil, err
-			} else {
-				log.Infof(c, "Fan-out to tile #%v returned %v slots", count, len(r))
-				result = append(result, r...)
-			}
-			begin = tileEnd
-			count++
+// Renders price statistics as a JSON array of candles, one per slot:
+// [begin (ms since epoch), open, high, low, close, number of trades].
+func renderPricesAsOhlc(w io.Writer, slots []timeslot, unit money.Unit) {
+	fmt.Fprintf(w, "[\n")
+	for i, slot := range slots {
+		comma := ","
+		if i == 0 {
+			comma = " "
 		}
-		log.Infof(c, "Fan-out to %v tiles returned %v slots", count, len(result))
-		return result, nil
+		fmt.Fprintf(w, "%v[%v, %v, %v, %v, %v, %v]\n", comma,
+			slot.Begin.UnixNano()/1000000,
+			slot.Open.Format(unit, false), slot.Max.Format(unit, false),
+			slot.Min.Format(unit, false), slot.Close.Format(unit, false),
+			slot.Count)
 	}
+	fmt.Fprintf(w, "]\n")
+}
 
-	// First try to answer from cache
-	key := fmt.Sprintf("prices-tile-%v/%v-%v-%v-%v", tile.name, res.name, begin.Format(time.RFC3339), article, currency)
-	if item, err := memcache.Get(c, key); err == nil {
-		result := make([]timeslot, 0)
-		if err := json.Unmarshal(item.Value, &result); err != nil {
-			// Shouldn't happen
-			log.Errorf(c, "Couldn't unmarshal memcache entry for: %v : %v", key, err)
-		} else {
-			return result, nil
-		}
+// Renders price statistics as CSV with a header line, one line per slot.
+func renderPricesAsCsv(w io.Writer, slots []timeslot, unit money.Unit) {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"begin", "end", "count", "open", "high", "low", "close", "vwap", "sum", "fees", "finished", "failed"})
+	for _, slot := range slots {
+		writer.Write([]string{
+			slot.Begin.Format(time.RFC3339),
+			slot.End.Format(time.RFC3339),
+			strconv.Itoa(slot.Count),
+			slot.Open.Format(unit, false),
+			slot.Max.Format(unit, false),
+			slot.Min.Format(unit, false),
+			slot.Close.Format(unit, false),
+			slot.VWAP.Format(unit, false),
+			slot.Sum.Format(unit, false),
+			slot.Fees.Format(unit, false),
+			strconv.Itoa(slot.Finished),
+			strconv.Itoa(slot.Failed),
+		})
 	}
+	writer.Flush()
+}
 
-	// Cache miss. Need to fetch data.
-	// If tile size is the smallest for the desired resolution, ask the datastore.
-	// Otherwise, recurse with next smaller tile size.
-	var result []timeslot
-	if tile == res.finestTileResolution() {
-
-		count := 0
-		currentSlot := timeslot{
-			Begin: begin,
-			End:   begin.Add(res.interval),
-		}
-		result = make([]timeslot, 0)
-
-		// Handler function that is called for every transaction in the current tile
-		handler := func(key string, tx bitwrk.Transaction) {
-			// Flush current interval to result list
-			for currentSlot.End.Before(tx.Matched) {
-				if currentSlot.Count > 0 {
-					result = append(result, currentSlot)
-					count += currentSlot.Count
-				}
-				currentSlot.advance()
-			}
-			currentSlot.addPrice(tx.Price)
-		}
-
-		// Query database
-		if err := db.QueryTransactions(c, 10000, article, currency, begin, end, handler); err != nil {
-			return nil, err
-		}
-
-		// Flush last interval
-		if currentSlot.Count > 0 {
-			result = append(result, currentSlot)
-			count += currentSlot.Count
-		}
+// Maximum number of time slots returned by a price query
+const maxPriceSlots = 10000
 
-		log.Infof(c, "QueryTransactions from %v to %v: %v slots/%v tx",
-			begin, end, len(result), count)
-	} else if r, err := queryPrices(c, article, currency, tile.nextFiner(), res, begin, end); err != nil {
+// Returns prices for trades between 'begin' and 'end', in resolution 'res', as kept in the
+// precomputed price statistics. Assumes that 'begin' is aligned with the resolution.
+func queryPrices(c context.Context, article bitwrk.ArticleId, currency money.Currency, res resolution, begin, end time.Time) ([]timeslot, error) {
+	slots, err := db.QueryPriceSlots(c, article, currency, res.name, begin, end, maxPriceSlots)
+	if err != nil {
 		return nil, err
-	} else {
-		result = r
-	}
-
-	// Before returning, update the cache.
-	item := memcache.Item{Key: key}
-	if data, err := json.Marshal(result); err != nil {
-		// Shouldn't happen
-		log.Errorf(c, "Error marshalling result: %v", err)
-	} else {
-		item.Value = data
 	}
 
-	// Tiles very close to now expire after 10 seconds
-	if begin.Add(tile.interval).After(time.Now().Add(-2 * time.Minute)) {
-		item.Expiration = 10 * time.Second
-	}
-
-	if err := memcache.Add(c, &item); err != nil {
-		log.Errorf(c, "Error caching item for %v: %v", key, err)
+	result := make([]timeslot, len(slots))
+	for i, slot := range slots {
+		result[i] = timeslot{
+			Begin: slot.Begin,
+			End:   slot.End,
+			Sum:   money.Money{Currency: currency, Amount: slot.Sum},
+			Min:   money.Money{Currency: currency, Amount: slot.Min},
+			Max:   money.Money{Currency: currency, Amount: slot.Max},
+			Count: slot.Count,
+
+			Open:     money.Money{Currency: currency, Amount: slot.Open},
+			Close:    money.Money{Currency: currency, Amount: slot.Close},
+			VWAP:     money.Money{Currency: currency, Amount: slot.Sum / int64(slot.Count)},
+			Fees:     money.Money{Currency: currency, Amount: slot.Fees},
+			Finished: slot.Finished,
+			Failed:   slot.Failed,
+		}
 	}
-
+	log.Infof(c, "Price statistics from %v to %v: %v slots", begin, end, len(result))
 	return result, nil
 }
 
@@ -451,7 +347,7 @@ func HandleQueryTrades(w http.ResponseWriter, r *http.Request) {
 	feeSum := priceSum
 
 	firstLine := true
-	handler := func(key string, tx bitwrk.Transaction) {
+	handler := func(key string, tx bitwrk.Transaction, ext db.TxExtension) {
 		var comma string
 		if firstLine {
 			firstLine = false
@@ -459,12 +355,12 @@ func HandleQueryTrades(w http.ResponseWriter, r *http.Request) {
 		} else {
 			comma = ","
 		}
-		fmt.Fprintf(buffer, "%v[% 5d, %#v, %v, %v, %v, \"%v\", \"%v\", %#v]\n", comma,
+		fmt.Fprintf(buffer, "%v[% 5d, %#v, %v, %v, %v, \"%v\", \"%v\", %#v, %#v]\n", comma,
 			count,
 			tx.Matched.Format(time.RFC3339Nano), tx.Matched.UnixNano()/1000000,
 			tx.Price.Format(unit, false),
 			tx.Fee.Format(unit, false),
-			tx.State, tx.Phase, key)
+			tx.State, tx.Phase, key, string(ext.PriceRule))
 
 		priceSum = priceSum.Add(tx.Price)
 		feeSum = feeSum.Add(tx.Fee)
@@ -0,0 +1,150 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// A trade as shown to the public. Neither participants nor keys are revealed.
+type publicTrade struct {
+	Matched  time.Time   `json:"matched"`
+	Retired  time.Time   `json:"retired"`
+	Article  string      `json:"article"`
+	Price    json.Number `json:"price"`
+	Fee      json.Number `json:"fee"`      // The fee actually charged
+	Phase    string      `json:"phase"`    // The phase the transaction ended in
+	Duration float64     `json:"duration"` // Seconds from matching to retirement
+}
+
+func newPublicTrade(tx *bitwrk.Transaction, ext *db.TxExtension, unit money.Unit) publicTrade {
+	return publicTrade{
+		Matched:  tx.Matched,
+		Retired:  ext.Retired,
+		Article:  string(tx.Article),
+		Price:    json.Number(tx.Price.Format(unit, false)),
+		Fee:      json.Number(db.ChargedFee(tx, ext).Format(unit, false)),
+		Phase:    tx.Phase.String(),
+		Duration: ext.Retired.Sub(tx.Matched).Seconds(),
+	}
+}
+
+// Maximum number of trades returned by a request for public trades
+const maxPublicTrades = 100
+
+// Lists an article's recently retired trades. By default, returns a page of trades,
+// most recently retired first, as {"trades": [...], "cursor": "..."}. Passing the cursor
+// returns the next page. In streaming mode, i.e. if parameter "since" is given, returns
+// at most limit trades retired at or after that time as JSON Lines, oldest first, and
+// a cursor in header "X-Cursor". Passing the cursor along with the same "since" returns
+// the trades that follow, including those retired in the meantime, so clients follow
+// the feed by polling.
+func HandleQueryPublicTrades(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	c := appengine.NewContext(r)
+
+	articleStr := r.FormValue("article")
+	var article bitwrk.ArticleId
+	if articleStr == "" {
+		http.Error(w, "article argument missing", http.StatusNotFound)
+		return
+	} else if err := util.CheckArticle(c, articleStr); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else {
+		article = bitwrk.ArticleId(articleStr)
+	}
+
+	limitStr := r.FormValue("limit")
+	var limit int
+	if limitStr == "" {
+		limit = 50
+	} else if n, err := strconv.Atoi(limitStr); err != nil || n <= 0 || n > maxPublicTrades {
+		http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	} else {
+		limit = n
+	}
+
+	var unit money.Unit
+	if r.FormValue("unit") == "" {
+		unit = money.MustParseUnit("mBTC")
+	} else if u, err := money.ParseUnit(r.FormValue("unit")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else {
+		unit = u
+	}
+
+	trades := make([]publicTrade, 0, limit)
+	handler := func(key string, tx bitwrk.Transaction, ext db.TxExtension) {
+		if tx.Price.Currency == unit.Currency {
+			trades = append(trades, newPublicTrade(&tx, &ext, unit))
+		}
+	}
+
+	if sinceStr := r.FormValue("since"); sinceStr != "" {
+		since, err := time.Parse(time.RFC3339Nano, sinceStr)
+		if err != nil {
+			http.Error(w, "Invalid since time", http.StatusBadRequest)
+			return
+		}
+		cursor, err := db.QueryTransactionsRetiredSince(c, article, since, r.FormValue("cursor"), limit, handler)
+		if err != nil {
+			log.Errorf(c, "Error querying public trades: %v", err)
+			http.Error(w, "Error querying trades", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Cursor", cursor)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Cursor")
+		w.Header().Set("Cache-Control", "no-cache")
+		encoder := json.NewEncoder(w)
+		for _, trade := range trades {
+			if err := encoder.Encode(trade); err != nil {
+				log.Errorf(c, "Error writing public trades: %v", err)
+				return
+			}
+		}
+		return
+	}
+
+	cursor, err := db.QueryRecentlyRetiredTransactions(c, article, r.FormValue("cursor"), limit, handler)
+	if err != nil {
+		log.Errorf(c, "Error querying public trades: %v", err)
+		http.Error(w, "Error querying trades", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=10")
+	if err := json.NewEncoder(w).Encode(struct {
+		Trades []publicTrade `json:"trades"`
+		Cursor string        `json:"cursor,omitempty"`
+	}{trades, cursor}); err != nil {
+		log.Errorf(c, "Error writing public trades: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	db "github.com/indyjo/bitwrk/server/gae"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// Lists the pairs of participants flagged by the wash-trade detector, most recently
+// seen first. Admin-only.
+func HandleQuerySuspicious(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !user.IsAdmin(c) {
+		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
+		return
+	}
+
+	limitStr := r.FormValue("limit")
+	var limit int
+	if limitStr == "" {
+		limit = 100
+	} else if n, err := strconv.ParseUint(limitStr, 10, 10); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		limit = int(n)
+	}
+
+	pairs, err := db.QuerySuspiciousPairs(c, limit)
+	if err != nil {
+		log.Errorf(c, "Error querying suspicious pairs: %v", err)
+		http.Error(w, "Error querying suspicious pairs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pairs); err != nil {
+		log.Errorf(c, "Error encoding suspicious pairs: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package segwit implements native SegWit (bech32) addresses and BIP-322 message
+// signatures for P2WPKH addresses.
+package segwit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+// Human-readable prefixes of SegWit addresses, by network
+const (
+	HrpMainnet = "bc"
+	HrpTestnet = "tb"
+	HrpRegtest = "bcrt"
+)
+
+// A decoded native SegWit address.
+type Address struct {
+	Hrp     string
+	Version byte   // Witness version, 0 to 16
+	Program []byte // Witness program, 2 to 40 bytes
+}
+
+// Returns whether s looks like a SegWit address for the given prefix. It doesn't
+// check whether the address is actually valid.
+func HasPrefix(s, hrp string) bool {
+	return strings.HasPrefix(strings.ToLower(s), hrp+"1")
+}
+
+// Decodes a SegWit address (BIP-173, BIP-350) and checks it belongs to the network
+// identified by hrp.
+func DecodeAddress(s, hrp string) (*Address, error) {
+	addr, err := decodeAddress(s)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Hrp != hrp {
+		return nil, fmt.Errorf("Address %#v is not for network %#v", s, hrp)
+	}
+	return addr, nil
+}
+
+// Decodes a SegWit address of any network.
+func decodeAddress(s string) (*Address, error) {
+	hrp, data, checksum, err := bech32.DecodeGeneric(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 || data[0] > 16 {
+		return nil, fmt.Errorf("Invalid witness version")
+	}
+
+	addr := &Address{Hrp: hrp, Version: data[0]}
+	if addr.Program, err = bech32.ConvertBits(data[1:], 5, 8, false); err != nil {
+		return nil, err
+	}
+	if len(addr.Program) < 2 || len(addr.Program) > 40 {
+		return nil, fmt.Errorf("Invalid witness program length %v", len(addr.Program))
+	}
+	if addr.Version == 0 && len(addr.Program) != 20 && len(addr.Program) != 32 {
+		return nil, fmt.Errorf("Invalid witness program length %v for version 0", len(addr.Program))
+	}
+	if (addr.Version == 0) != (checksum == bech32.Version0) {
+		return nil, fmt.Errorf("Wrong checksum variant for witness version %v", addr.Version)
+	}
+
+	return addr, nil
+}
+
+// Whether the address is pay-to-witness-public-key-hash, i.e. controlled by a single key.
+func (addr *Address) IsP2WPKH() bool {
+	return addr.Version == 0 && len(addr.Program) == 20
+}
+
+// Returns the script that locks funds to the address.
+func (addr *Address) ScriptPubKey() []byte {
+	script := make([]byte, 0, 2+len(addr.Program))
+	if addr.Version == 0 {
+		script = append(script, 0x00)
+	} else {
+		script = append(script, 0x50+addr.Version) // OP_1 to OP_16
+	}
+	script = append(script, byte(len(addr.Program)))
+	return append(script, addr.Program...)
+}
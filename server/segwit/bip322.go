@@ -0,0 +1,242 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package segwit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/indyjo/bitwrk-common/bitcoin"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// BIP-322 signatures prove control of an address by signing a virtual transaction
+// that spends from it. This file implements the "simple" signature format for
+// P2WPKH addresses: The signature is the witness stack of the virtual spend.
+
+const sighashAll = 0x01
+
+// Returns the BIP-340 tagged hash of a message, as used by BIP-322.
+func MessageHash(message string) [32]byte {
+	tag := sha256.Sum256([]byte("BIP0322-signed-message"))
+	h := sha256.New()
+	h.Write(tag[:])
+	h.Write(tag[:])
+	h.Write([]byte(message))
+	var result [32]byte
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// Returns RIPEMD160(SHA256(data)), which identifies a public key in an address.
+func hash160(data []byte) []byte {
+	sha := sha256.Sum256(data)
+	h := ripemd160.New()
+	h.Write(sha[:])
+	return h.Sum(nil)
+}
+
+func doubleSha256(data []byte) [32]byte {
+	first := sha256.Sum256(data)
+	return sha256.Sum256(first[:])
+}
+
+func writeVarInt(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 0xfd:
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(0xfd)
+		binary.Write(buf, binary.LittleEndian, uint16(n))
+	case n <= 0xffffffff:
+		buf.WriteByte(0xfe)
+		binary.Write(buf, binary.LittleEndian, uint32(n))
+	default:
+		buf.WriteByte(0xff)
+		binary.Write(buf, binary.LittleEndian, n)
+	}
+}
+
+func readVarInt(r *bytes.Reader) (uint64, error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch prefix {
+	case 0xfd:
+		var n uint16
+		err = binary.Read(r, binary.LittleEndian, &n)
+		return uint64(n), err
+	case 0xfe:
+		var n uint32
+		err = binary.Read(r, binary.LittleEndian, &n)
+		return uint64(n), err
+	case 0xff:
+		var n uint64
+		err = binary.Read(r, binary.LittleEndian, &n)
+		return n, err
+	default:
+		return uint64(prefix), nil
+	}
+}
+
+// Decodes a serialized witness stack.
+func parseWitness(b []byte) ([][]byte, error) {
+	r := bytes.NewReader(b)
+	count, err := readVarInt(r)
+	if err != nil || count > 16 {
+		return nil, fmt.Errorf("Invalid witness")
+	}
+	stack := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, err := readVarInt(r)
+		if err != nil || length > uint64(r.Len()) {
+			return nil, fmt.Errorf("Invalid witness")
+		}
+		item := make([]byte, length)
+		r.Read(item)
+		stack = append(stack, item)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("Trailing bytes after witness")
+	}
+	return stack, nil
+}
+
+// Returns the id of BIP-322's virtual "to_spend" transaction, in internal byte order.
+func toSpendTxId(scriptPubKey []byte, messageHash [32]byte) [32]byte {
+	var tx bytes.Buffer
+	binary.Write(&tx, binary.LittleEndian, uint32(0)) // version
+	writeVarInt(&tx, 1)                               // one input...
+	tx.Write(make([]byte, 32))                        // ...spending from nothing
+	binary.Write(&tx, binary.LittleEndian, uint32(0xffffffff))
+	writeVarInt(&tx, 34) // scriptSig: OP_0 PUSH32 <message hash>
+	tx.Write([]byte{0x00, 0x20})
+	tx.Write(messageHash[:])
+	binary.Write(&tx, binary.LittleEndian, uint32(0)) // sequence
+	writeVarInt(&tx, 1)                               // one output...
+	binary.Write(&tx, binary.LittleEndian, uint64(0)) // ...of value 0...
+	writeVarInt(&tx, uint64(len(scriptPubKey)))       // ...paying to the address
+	tx.Write(scriptPubKey)
+	binary.Write(&tx, binary.LittleEndian, uint32(0)) // lock time
+	return doubleSha256(tx.Bytes())
+}
+
+// Returns the BIP-143 signature hash (SIGHASH_ALL) of BIP-322's virtual "to_sign"
+// transaction, which spends to_spend's only output using P2WPKH.
+func toSignSighash(toSpend [32]byte, pubKeyHash []byte) [32]byte {
+	var outpoint bytes.Buffer
+	outpoint.Write(toSpend[:])
+	binary.Write(&outpoint, binary.LittleEndian, uint32(0))
+
+	sequence := make([]byte, 4)
+
+	var output bytes.Buffer
+	binary.Write(&output, binary.LittleEndian, uint64(0))
+	writeVarInt(&output, 1)
+	output.WriteByte(0x6a) // OP_RETURN
+
+	hashPrevouts := doubleSha256(outpoint.Bytes())
+	hashSequence := doubleSha256(sequence)
+	hashOutputs := doubleSha256(output.Bytes())
+
+	var preimage bytes.Buffer
+	binary.Write(&preimage, binary.LittleEndian, uint32(0)) // version
+	preimage.Write(hashPrevouts[:])
+	preimage.Write(hashSequence[:])
+	preimage.Write(outpoint.Bytes())
+	// Script code of P2WPKH: OP_DUP OP_HASH160 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG
+	preimage.Write([]byte{0x19, 0x76, 0xa9, 0x14})
+	preimage.Write(pubKeyHash)
+	preimage.Write([]byte{0x88, 0xac})
+	binary.Write(&preimage, binary.LittleEndian, uint64(0)) // amount
+	preimage.Write(sequence)
+	preimage.Write(hashOutputs[:])
+	binary.Write(&preimage, binary.LittleEndian, uint32(0))          // lock time
+	binary.Write(&preimage, binary.LittleEndian, uint32(sighashAll)) // sighash type
+	return doubleSha256(preimage.Bytes())
+}
+
+// Verifies a base64-encoded BIP-322 "simple" signature of message, made with the key
+// controlling the given P2WPKH address.
+func VerifySimpleSignature(message string, addr *Address, signatureBase64 string) error {
+	if !addr.IsP2WPKH() {
+		return fmt.Errorf("Only P2WPKH addresses can be verified")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return fmt.Errorf("Invalid base64 signature: %v", err)
+	}
+	witness, err := parseWitness(raw)
+	if err != nil {
+		return err
+	}
+	if len(witness) != 2 || len(witness[0]) < 2 {
+		return fmt.Errorf("Witness must consist of a signature and a public key")
+	}
+
+	sig, pubKeyBytes := witness[0], witness[1]
+	if sig[len(sig)-1] != sighashAll {
+		return fmt.Errorf("Unsupported signature hash type %v", sig[len(sig)-1])
+	}
+	if len(pubKeyBytes) != 33 {
+		return fmt.Errorf("P2WPKH requires a compressed public key")
+	}
+	if !bytes.Equal(hash160(pubKeyBytes), addr.Program) {
+		return fmt.Errorf("Public key doesn't match address")
+	}
+
+	pub, err := btcec.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+	signature, err := ecdsa.ParseDERSignature(sig[:len(sig)-1])
+	if err != nil {
+		return err
+	}
+
+	toSpend := toSpendTxId(addr.ScriptPubKey(), MessageHash(message))
+	sighash := toSignSighash(toSpend, addr.Program)
+	if !signature.Verify(sighash[:], pub) {
+		return fmt.Errorf("Signature verification failed")
+	}
+	return nil
+}
+
+// Verifies a base64-encoded signature of message, made with the key controlling address.
+// Native SegWit addresses of any network are verified according to BIP-322 (see
+// VerifySimpleSignature), others as legacy addresses signed with "signmessage". Unlike
+// the server, which only accepts addresses of its own network, clients don't know the
+// network and use this function.
+func VerifySignature(message, address, signatureBase64 string) error {
+	for _, hrp := range []string{HrpMainnet, HrpTestnet, HrpRegtest} {
+		if HasPrefix(address, hrp) {
+			if addr, err := decodeAddress(address); err != nil {
+				return err
+			} else {
+				return VerifySimpleSignature(message, addr, signatureBase64)
+			}
+		}
+	}
+	return bitcoin.VerifySignatureBase64(message, address, signatureBase64)
+}
@@ -0,0 +1,100 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package segwit
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestHash160(t *testing.T) {
+	// Public key and address from the BIP-322 test vectors
+	pubKey, _ := hex.DecodeString("02c7f12003196442943d8588e01aee840423cc54fc1521526a3b85c2b0cbd58872")
+	if actual := hex.EncodeToString(hash160(pubKey)); actual != "2b05d564e6a7a33c087f16e0f730d1440123799d" {
+		t.Errorf("Expected hash160 of BIP-322 test key, got: %v", actual)
+	}
+}
+
+func TestDecodeAddress(t *testing.T) {
+	expect := func(address, hrp string, version byte, program string) {
+		addr, err := DecodeAddress(address, hrp)
+		if err != nil {
+			t.Errorf("Decoding %#v failed: %v", address, err)
+		} else if addr.Version != version || hex.EncodeToString(addr.Program) != program {
+			t.Errorf("Expected: %#v to decode to version %v, program %v  --  Got: %v, %x",
+				address, version, program, addr.Version, addr.Program)
+		}
+	}
+	expectError := func(address, hrp string) {
+		if _, err := DecodeAddress(address, hrp); err == nil {
+			t.Errorf("Expected decoding %#v to fail", address)
+		}
+	}
+
+	expect("BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", HrpMainnet, 0,
+		"751e76e8199196d454941c45d1b3a323f1433bd6")
+	expect("tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", HrpTestnet, 0,
+		"1863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262")
+	expect("bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", HrpMainnet, 1,
+		"79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+
+	// Wrong network
+	expectError("BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", HrpTestnet)
+	// Invalid checksum
+	expectError("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", HrpMainnet)
+	// Mixed case
+	expectError("bc1qW508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", HrpMainnet)
+	// Version 1 with bech32 instead of bech32m checksum
+	expectError("bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7k7grplx", HrpMainnet)
+}
+
+func TestMessageHash(t *testing.T) {
+	expect := func(message, expected string) {
+		actual := MessageHash(message)
+		if hex.EncodeToString(actual[:]) != expected {
+			t.Errorf("Expected: MessageHash(%#v) = %v  --  Got: %x", message, expected, actual)
+		}
+	}
+
+	expect("", "c90c269c4f8fcbe6880f72a721ddfbf1914268a794cbb21cfafee13770ae19f1")
+	expect("Hello World", "f0eb03b1a75ac6d9847f55c624a99169b5dccba2a31f5b23bea77ba270de0a7a")
+}
+
+func TestVerifySimpleSignature(t *testing.T) {
+	// Test vectors from BIP-322
+	const address = "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l"
+	const sigEmpty = "AkcwRAIgM2gBAQqvZX15ZiysmKmQpDrG83avLIT492QBzLnQIxYCIBaTpOaD20qRlEylyxFSeEA2ba9YOixpX8z46TSDtS40ASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI="
+	const sigHello = "AkcwRAIgZRfIY3p7/DoVTty6YZbWS71bc5Vct9p9Fia83eRmw2QCICK/ENGfwLtptFluMGs2KsqoNSk89pO7F29zJLUx9a/sASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI="
+
+	addr, err := DecodeAddress(address, HrpMainnet)
+	if err != nil {
+		t.Fatalf("Decoding address failed: %v", err)
+	}
+
+	if err := VerifySimpleSignature("", addr, sigEmpty); err != nil {
+		t.Errorf("Valid signature of empty message rejected: %v", err)
+	}
+	if err := VerifySimpleSignature("Hello World", addr, sigHello); err != nil {
+		t.Errorf("Valid signature of \"Hello World\" rejected: %v", err)
+	}
+	if err := VerifySimpleSignature("Hello World", addr, sigEmpty); err == nil {
+		t.Errorf("Signature of a different message accepted")
+	}
+	if err := VerifySimpleSignature("", addr, "AAAA"); err == nil {
+		t.Errorf("Garbage signature accepted")
+	}
+}
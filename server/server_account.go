@@ -49,6 +49,15 @@ const accountViewHtml = `
 <tr><th></th><td><a href="/ledger/{{.Account.LastMovementKey}}">Last ledger entry</a></td></tr>
 {{end}}
 </table>
+{{if .Team}}
+<h1>Team Members</h1>
+<table>
+<tr><th>Member</th><th>Daily limit</th><th>Left today</th><th>Total limit</th><th>Left in total</th></tr>
+{{range .Team}}
+<tr><td><a href="/account/{{.Address}}">{{.Address}}</a></td><td>{{.DailyLimit}}</td><td>{{.LeftToday}}</td><td>{{.TotalLimit}}</td><td>{{.LeftTotal}}</td></tr>
+{{end}}
+</table>
+{{end}}
 {{if .DeveloperMode}}
 <script src="/js/getnonce.js" ></script>
 <script src="/js/createdepositinfo.js" ></script>
@@ -122,12 +131,22 @@ func handleAccount(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Organization accounts show their team members' budgets
+		var budgets []db.MemberBudget
+		if team, err := db.GetTeam(c, accountId); err == nil {
+			budgets = team.Budgets(time.Now())
+		} else if err != db.ErrNoSuchTeam {
+			http.Error(w, "Error retrieving team", http.StatusInternalServerError)
+			log.Errorf(c, "Error getting team %v: %v", accountId, err)
+			return
+		}
+
 		w.Header().Set("Content-Type", contentType)
 		if contentType == "application/json" {
-			err = renderAccountJson(w, &account)
+			err = renderAccountJson(w, &account, budgets)
 		} else {
 			devmode := r.FormValue("developermode") != ""
-			err = renderAccountHtml(w, &account, devmode)
+			err = renderAccountHtml(w, &account, budgets, devmode)
 		}
 
 		if err != nil {
@@ -137,6 +156,10 @@ func handleAccount(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		c := appengine.NewContext(r)
 		log.Infof(c, "Got POST for account: %v", accountId)
+		if err := checkMaintenance(c); err != nil {
+			writeLegacyError(w, err.Error(), err)
+			return
+		}
 		action := r.FormValue("action")
 		if action == "storedepositinfo" {
 			if err := storeDepositInfo(c, r, accountId); err != nil {
@@ -158,21 +181,35 @@ func handleAccount(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func renderAccountHtml(w http.ResponseWriter, account *bitwrk.ParticipantAccount, devmode bool) (err error) {
+func renderAccountHtml(w http.ResponseWriter, account *bitwrk.ParticipantAccount, team []db.MemberBudget, devmode bool) (err error) {
 	return accountViewTemplate.Execute(w, struct {
 		Account        *bitwrk.ParticipantAccount
+		Team           []db.MemberBudget
 		DeveloperMode  bool
 		TrustedAccount string
 		Available      money.Money
 		Blocked        money.Money
-	}{account, devmode, config.CfgTrustedAccount,
+	}{account, team, devmode, config.CfgTrustedAccount,
 		money.Money{account.AvailableAmount, account.Currency},
 		money.Money{account.AvailableAmount, account.Currency},
 	})
 }
 
-func renderAccountJson(w http.ResponseWriter, account *bitwrk.ParticipantAccount) (err error) {
-	return json.NewEncoder(w).Encode(json.Marshaler(account))
+// Renders the account as JSON. If the account belongs to a team's organization,
+// a "Team" field lists the members' budgets.
+func renderAccountJson(w http.ResponseWriter, account *bitwrk.ParticipantAccount, team []db.MemberBudget) (err error) {
+	if team == nil {
+		return json.NewEncoder(w).Encode(json.Marshaler(account))
+	}
+
+	var fields map[string]interface{}
+	if data, err := account.MarshalJSON(); err != nil {
+		return err
+	} else if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	fields["Team"] = team
+	return json.NewEncoder(w).Encode(fields)
 }
 
 func requestDepositAddress(c context.Context, r *http.Request, participant string) (err error) {
@@ -195,7 +232,7 @@ func requestDepositAddress(c context.Context, r *http.Request, participant strin
 
 	// Verify that the request was indeed signed correctly
 	if config.CfgRequireValidSignature {
-		if err := m.VerifyWith(m.Signer); err != nil {
+		if err := verifyDepositAddressRequest(&m, r.FormValue("signature")); err != nil {
 			return fmt.Errorf("After verifying %#v against %v: %v", m, m.Signer, err)
 		}
 	}
@@ -229,6 +266,19 @@ func requestDepositAddress(c context.Context, r *http.Request, participant strin
 	return
 }
 
+// Verifies a deposit address request against its signer. Requests signed by legacy
+// addresses are verified by bitwrk-common. Native SegWit signers sign the request's
+// values except the signature, URL-encoded in key order, according to BIP-322.
+func verifyDepositAddressRequest(m *bitwrk.DepositAddressRequest, signature string) error {
+	if !util.IsSegwitAddress(m.Signer) {
+		return m.VerifyWith(m.Signer)
+	}
+	v := url.Values{}
+	m.ToValues(v)
+	v.Del("signature")
+	return util.VerifySignature(v.Encode(), m.Signer, signature)
+}
+
 func storeDepositInfo(c context.Context, r *http.Request, participant string) (err error) {
 	// Important: checking (and invalidating) the nonce must be the first thing we do!
 	err = checkNonce(c, r.FormValue("nonce"))
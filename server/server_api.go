@@ -0,0 +1,469 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk/server/config"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// The /v2/ API offers the same operations as the original endpoints, but reports
+// errors as JSON objects with machine-readable codes and meaningful status codes.
+// Requests may be sent as form data or as a flat JSON object.
+
+// An error as reported by the /v2/ API. Field names the request parameter that
+// caused the error, if any.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+
+	// The prices accepted for the article, if the error concerns a bid's price
+	Prices *priceLimits `json:"prices,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func badRequest(field, format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusBadRequest, "invalid_parameter", fmt.Sprintf(format, args...), field, nil}
+}
+
+func notFound(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusNotFound, "not_found", fmt.Sprintf(format, args...), "", nil}
+}
+
+func nonceError(err error) *apiError {
+	return &apiError{http.StatusConflict, "invalid_nonce", fmt.Sprintf("Error in checkNonce: %v", err), "nonce", nil}
+}
+
+func signatureError(err error) *apiError {
+	return &apiError{http.StatusBadRequest, "invalid_signature", err.Error(), "signature", nil}
+}
+
+func clientOutdated(version, minVersion util.ClientVersion, article string) *apiError {
+	return &apiError{http.StatusUpgradeRequired, "client_outdated",
+		fmt.Sprintf("Client version %v is no longer supported for article %v. Please upgrade to version %v or later.",
+			version, article, minVersion), "", nil}
+}
+
+func workerUnreachable(workerURL string, err error) *apiError {
+	return &apiError{http.StatusBadGateway, "worker_unreachable",
+		fmt.Sprintf("Worker at %v can't be reached: %v", workerURL, err), "workerurl", nil}
+}
+
+// Maximum size of a request body accepted by the /v2/ API
+const maxApiRequestSize = 64 * 1024
+
+// Translates any error into an *apiError. Errors not known to be caused by the
+// request are reported as internal errors.
+func toApiError(err error) *apiError {
+	switch e := err.(type) {
+	case *apiError:
+		return e
+	case *db.InsufficientFundsError:
+		return &apiError{http.StatusPaymentRequired, "insufficient_funds", e.Error(), "", nil}
+	case *db.ConflictError:
+		return &apiError{http.StatusConflict, "conflict", e.Error(), "", nil}
+	case *db.PermissionError:
+		return &apiError{http.StatusForbidden, "forbidden", e.Error(), "", nil}
+	}
+
+	switch err {
+	case db.ErrTransactionAlreadyRetired, db.ErrTransactionTooOld, db.ErrTransactionDisputed:
+		return &apiError{http.StatusConflict, "conflict", err.Error(), "", nil}
+	case db.ErrNoSuchTeam, datastore.ErrNoSuchEntity, bitwrk.ErrNoSuchObject:
+		return notFound("%v", err)
+	case datastore.ErrConcurrentTransaction:
+		// Too many requests competing for the same entities
+		return &apiError{http.StatusTooManyRequests, "contention", err.Error(), "", nil}
+	}
+
+	return &apiError{http.StatusInternalServerError, "internal_error", err.Error(), "", nil}
+}
+
+func writeApiError(c context.Context, w http.ResponseWriter, err error) {
+	e := toApiError(err)
+	if e.Status >= 500 {
+		log.Errorf(c, "API request failed: %v", err)
+	} else {
+		log.Infof(c, "API request rejected: %v", err)
+	}
+	if e.Status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeApiJson(c, w, e.Status, e)
+}
+
+// Codes of errors the original endpoints report with their own status code
+var legacyErrorCodes = []string{"client_outdated", "market_halted", "maintenance", "suspended"}
+
+// The original endpoints report errors as internal errors, except for outdated clients,
+// which are told to upgrade, halts of trading and suspended participants.
+func writeLegacyError(w http.ResponseWriter, message string, err error) {
+	if e, ok := err.(*apiError); ok && containsString(legacyErrorCodes, e.Code) {
+		http.Error(w, e.Code+": "+e.Message, e.Status)
+	} else {
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
+
+func writeApiJson(c context.Context, w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf(c, "Error encoding API response: %v", err)
+	}
+}
+
+func methodNotAllowed(method string) *apiError {
+	return &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed: " + method, "", nil}
+}
+
+// Returns the parameters of a request, which are either given as form data or as a
+// JSON object whose values are strings, numbers or booleans.
+func apiRequestValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != "POST" || mediaType != "application/json" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxApiRequestSize)
+		if err := r.ParseForm(); err != nil {
+			return nil, badRequest("", "Couldn't parse form data: %v", err)
+		}
+		return r.Form, nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxApiRequestSize))
+	if err != nil {
+		return nil, badRequest("", "Couldn't read request: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, badRequest("", "Request must be a JSON object: %v", err)
+	}
+
+	values := make(url.Values, len(fields))
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			values.Set(k, v)
+		case float64:
+			values.Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			values.Set(k, strconv.FormatBool(v))
+		default:
+			return nil, badRequest(k, "Value of %#v must be a string, number or boolean", k)
+		}
+	}
+	return values, nil
+}
+
+// Handler function for /v2/nonce
+func handleApiNonce(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "GET" && r.Method != "POST" {
+		writeApiError(c, w, methodNotAllowed(r.Method))
+		return
+	}
+
+	if nonce, err := issueNonce(c, r); err != nil {
+		writeApiError(c, w, err)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		writeApiJson(c, w, http.StatusOK, struct {
+			Nonce string `json:"nonce"`
+		}{nonce})
+	}
+}
+
+// Handler function for /v2/bid (creating bids) and /v2/bid/<bidid>
+func handleApiBid(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	bidId := strings.TrimPrefix(r.URL.Path, "/v2/bid")
+	bidId = strings.TrimPrefix(bidId, "/")
+
+	if bidId == "" {
+		if r.Method != "POST" {
+			writeApiError(c, w, methodNotAllowed(r.Method))
+			return
+		}
+		values, err := apiRequestValues(w, r)
+		if err != nil {
+			writeApiError(c, w, err)
+			return
+		}
+		bidKey, bid, created, err := createBid(c, values, r.UserAgent())
+		if err != nil {
+			writeApiError(c, w, err)
+			return
+		}
+
+		// A repeated request returns the original bid
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Location", "/v2/bid/"+bidKey.Encode())
+		if err := renderApiBid(c, w, status, bidKey.Encode()); err != nil {
+			writeApiError(c, w, err)
+		}
+
+		if !created {
+			log.Infof(c, "Bid request repeated, returning existing bid %v", bidKey)
+		} else if err := db.TriggerBatchProcessing(c, bid.Article, bid.MatchKey()); err != nil {
+			log.Errorf(c, "Batch processing bids failed: %v", err)
+		}
+	} else if r.Method == "GET" {
+		if err := renderApiBid(c, w, http.StatusOK, bidId); err != nil {
+			writeApiError(c, w, err)
+		}
+	} else {
+		writeApiError(c, w, methodNotAllowed(r.Method))
+	}
+}
+
+func renderApiBid(c context.Context, w http.ResponseWriter, status int, bidId string) error {
+	bid, ext, err := db.GetBid(c, bidId)
+	if err != nil {
+		log.Warningf(c, "Bid %v not found: %v", bidId, err)
+		return notFound("Bid not found: %v", bidId)
+	}
+	writeApiJson(c, w, status, struct {
+		Id string
+		bitwrk.Bid
+		db.BidExtension
+	}{bidId, *bid, *ext})
+	return nil
+}
+
+// Handler function for /v2/tx/<txid>. GET returns the transaction, POST sends a message.
+func handleApiTx(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	txId := strings.TrimPrefix(r.URL.Path, "/v2/tx/")
+	txKey, err := datastore.DecodeKey(txId)
+	if err != nil {
+		writeApiError(c, w, notFound("Transaction not found: %v", txId))
+		return
+	}
+
+	if r.Method == "POST" {
+		values, err := apiRequestValues(w, r)
+		if err != nil {
+			writeApiError(c, w, err)
+			return
+		}
+		if err := updateTransaction(c, values, util.ClientAddr(r), r.UserAgent(), txId, txKey); err != nil {
+			writeApiError(c, w, err)
+			return
+		}
+	} else if r.Method != "GET" {
+		writeApiError(c, w, methodNotAllowed(r.Method))
+		return
+	}
+
+	tx, ext, err := db.GetTransaction(c, txKey)
+	if err == datastore.ErrNoSuchEntity {
+		writeApiError(c, w, notFound("Transaction not found: %v", txId))
+	} else if err != nil {
+		writeApiError(c, w, err)
+	} else {
+		writeApiJson(c, w, http.StatusOK, struct {
+			Id string
+			bitwrk.Transaction
+			publicTxExtension
+		}{txId, *tx, newPublicTxExtension(ext)})
+	}
+}
+
+// Handler function for /v2/account/<accountid>
+func handleApiAccount(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "GET" {
+		writeApiError(c, w, methodNotAllowed(r.Method))
+		return
+	}
+
+	accountId := strings.TrimPrefix(r.URL.Path, "/v2/account/")
+	if err := util.CheckBitcoinAddress(accountId); err != nil {
+		writeApiError(c, w, notFound("%v", err))
+		return
+	}
+
+	account, err := db.NewGaeAccountingDao(c, false).GetAccount(accountId)
+	if err != nil {
+		writeApiError(c, w, err)
+		return
+	}
+
+	var budgets []db.MemberBudget
+	if team, err := db.GetTeam(c, accountId); err == nil {
+		budgets = team.Budgets(time.Now())
+	} else if err != db.ErrNoSuchTeam {
+		writeApiError(c, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := renderAccountJson(w, &account, budgets); err != nil {
+		log.Errorf(c, "Error rendering %v: %v", r.URL, err)
+	}
+}
+
+// Maximum number of bids accepted by /v2/bids at once, and the maximum size of such a request
+const (
+	maxBatchSize        = 100
+	maxBatchRequestSize = 512 * 1024
+)
+
+// Result of one bid of a batch, as returned by /v2/bids
+type apiBatchResult struct {
+	Id      string    `json:"id,omitempty"`
+	Created bool      `json:"created,omitempty"`
+	Error   *apiError `json:"error,omitempty"`
+}
+
+// Handler function for /v2/bids. Creates a number of bids sharing a single nonce.
+// The request is a JSON object {"nonce": ..., "bids": [...]}, where each bid is an
+// object with the parameters accepted by /v2/bid, except for the nonce. Every bid is
+// signed individually, using the shared nonce. The response lists the outcome of each
+// bid, in order.
+func handleApiBids(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		writeApiError(c, w, methodNotAllowed(r.Method))
+		return
+	}
+
+	var batch struct {
+		Nonce string              `json:"nonce"`
+		Bids  []map[string]string `json:"bids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestSize)).Decode(&batch); err != nil {
+		writeApiError(c, w, badRequest("", "Request must be a JSON object with a nonce and a list of bids: %v", err))
+		return
+	} else if len(batch.Bids) == 0 || len(batch.Bids) > maxBatchSize {
+		writeApiError(c, w, badRequest("bids", "A batch must contain between 1 and %v bids", maxBatchSize))
+		return
+	}
+
+	// Important: checking (and invalidating) the nonce must be the first thing we do!
+	nonce, err := useNonce(c, batch.Nonce)
+	if config.CfgRequireValidNonce && err != nil {
+		writeApiError(c, w, nonceError(err))
+		return
+	}
+
+	results := make([]apiBatchResult, len(batch.Bids))
+	bids := make([]*bitwrk.Bid, 0, len(batch.Bids))
+	exts := make([]*db.BidExtension, 0, len(batch.Bids))
+	indexes := make([]int, 0, len(batch.Bids))
+	requestIds := make(map[string]bool)
+	for i, fields := range batch.Bids {
+		values := make(url.Values, len(fields)+1)
+		for k, v := range fields {
+			values.Set(k, v)
+		}
+		if nonce, ok := fields["nonce"]; ok && nonce != batch.Nonce {
+			results[i].Error = badRequest("nonce", "All bids of a batch must use the batch's nonce")
+			continue
+		}
+		values.Set("nonce", batch.Nonce)
+
+		bid, ext, err := prepareBid(c, values, r.UserAgent())
+		if err != nil {
+			results[i].Error = toApiError(err)
+			continue
+		}
+		if nonce != nil {
+			ext.RemoteAddr = nonce.RemoteAddr
+		}
+
+		// Request IDs must be unique within a batch, as bids enqueued together can't see each other
+		if ext.RequestId != "" {
+			signer := bid.Participant
+			if ext.Signer != "" {
+				signer = ext.Signer
+			}
+			requestKey := signer + "/" + ext.RequestId
+			if requestIds[requestKey] {
+				results[i].Error = badRequest("requestid", "Request ID %v used twice", ext.RequestId)
+				continue
+			}
+			requestIds[requestKey] = true
+		}
+
+		bids = append(bids, bid)
+		exts = append(exts, ext)
+		indexes = append(indexes, i)
+	}
+
+	matchKeys := make([]string, 0, 4)
+	articles := make([]bitwrk.ArticleId, 0, 4)
+	for j, result := range db.EnqueueBids(c, bids, exts) {
+		i := indexes[j]
+		if result.Err != nil {
+			results[i].Error = toApiError(result.Err)
+			continue
+		}
+		results[i].Id = result.Key.Encode()
+		results[i].Created = result.Created
+
+		if matchKey := bids[j].MatchKey(); result.Created && !containsString(matchKeys, matchKey) {
+			matchKeys = append(matchKeys, matchKey)
+			articles = append(articles, bids[j].Article)
+		}
+	}
+
+	writeApiJson(c, w, http.StatusOK, struct {
+		Bids []apiBatchResult `json:"bids"`
+	}{results})
+
+	// Matching is triggered once per article and currency
+	for k, matchKey := range matchKeys {
+		if err := db.TriggerBatchProcessing(c, articles[k], matchKey); err != nil {
+			log.Errorf(c, "Batch processing bids failed: %v", err)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
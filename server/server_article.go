@@ -0,0 +1,128 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+)
+
+// The prices accepted for an article's bids, as published to clients. Empty values
+// mean there is no restriction.
+type priceLimits struct {
+	Min  string `json:"min,omitempty"`
+	Max  string `json:"max,omitempty"`
+	Tick string `json:"tick,omitempty"`
+}
+
+func (l *priceLimits) String() string {
+	parts := make([]string, 0, 3)
+	if l.Min != "" {
+		parts = append(parts, "at least "+l.Min)
+	}
+	if l.Max != "" {
+		parts = append(parts, "at most "+l.Max)
+	}
+	if l.Tick != "" {
+		parts = append(parts, "a multiple of "+l.Tick)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Parses a configured price, which may be empty.
+func parsePriceSetting(article, name, s string) (*money.Money, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if m, err := money.Parse(s); err != nil {
+		return nil, fmt.Errorf("Invalid %v configured for article %v: %v", name, article, err)
+	} else {
+		return &m, nil
+	}
+}
+
+// Checks a bid's price against the minimum price, maximum price and tick size
+// configured for the article. Prices out of range are reported as *apiError naming
+// the accepted range.
+func checkPrice(article string, price money.Money) error {
+	settings := config.GetArticleSettings(article)
+	if settings.MinPrice == "" && settings.MaxPrice == "" && settings.TickSize == "" {
+		return nil
+	}
+
+	var min, max, tick *money.Money
+	var err error
+	if min, err = parsePriceSetting(article, "minimum price", settings.MinPrice); err != nil {
+		return err
+	} else if max, err = parsePriceSetting(article, "maximum price", settings.MaxPrice); err != nil {
+		return err
+	} else if tick, err = parsePriceSetting(article, "tick size", settings.TickSize); err != nil {
+		return err
+	}
+
+	valid := true
+	for _, limit := range []*money.Money{min, max, tick} {
+		if limit != nil && limit.Currency != price.Currency {
+			valid = false
+		}
+	}
+	if min != nil && price.Amount < min.Amount {
+		valid = false
+	}
+	if max != nil && price.Amount > max.Amount {
+		valid = false
+	}
+	if tick != nil && tick.Amount > 0 && price.Amount%tick.Amount != 0 {
+		valid = false
+	}
+	if valid {
+		return nil
+	}
+
+	limits := &priceLimits{settings.MinPrice, settings.MaxPrice, settings.TickSize}
+	return &apiError{http.StatusBadRequest, "invalid_price",
+		fmt.Sprintf("Price %v not accepted for article %v. Price must be %v.", price, article, limits),
+		"price", limits}
+}
+
+// Handler function for /v2/article/<articleid>. Returns the settings in force for
+// the article, including the prices accepted for bids.
+func handleApiArticle(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "GET" {
+		writeApiError(c, w, methodNotAllowed(r.Method))
+		return
+	}
+
+	article := strings.TrimPrefix(r.URL.Path, "/v2/article/")
+	if err := util.CheckArticle(c, article); err != nil {
+		writeApiError(c, w, notFound("%v", err))
+		return
+	}
+
+	settings := config.GetArticleSettings(article)
+	writeApiJson(c, w, http.StatusOK, struct {
+		Id string
+		config.ArticleSettings
+	}{article, settings})
+}
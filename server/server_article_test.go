@@ -0,0 +1,69 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+)
+
+func TestCheckPrice(t *testing.T) {
+	config.CfgArticleSettings["test-limited"] = config.ArticleSettings{
+		PriceRule: "resting",
+		MinPrice:  "mBTC1",
+		MaxPrice:  "mBTC100",
+		TickSize:  "mBTC0.5",
+	}
+	config.CfgArticleSettings["test-misconfigured"] = config.ArticleSettings{
+		PriceRule: "resting",
+		MinPrice:  "one mBTC",
+	}
+	defer delete(config.CfgArticleSettings, "test-limited")
+	defer delete(config.CfgArticleSettings, "test-misconfigured")
+
+	expect := func(article, price string, valid bool) {
+		m, err := money.Parse(price)
+		if err != nil {
+			t.Fatalf("Can't parse %#v: %v", price, err)
+		}
+		if err := checkPrice(article, m); valid && err != nil {
+			t.Errorf("Expected %v to be accepted for %v, got: %v", price, article, err)
+		} else if !valid && err == nil {
+			t.Errorf("Expected %v to be rejected for %v", price, article)
+		} else if e, ok := err.(*apiError); !valid && (!ok || e.Code != "invalid_price" || e.Prices == nil) {
+			t.Errorf("Expected %v to be rejected for %v naming the accepted prices, got: %#v", price, article, err)
+		}
+	}
+
+	expect("test-limited", "mBTC1", true)
+	expect("test-limited", "mBTC2.5", true)
+	expect("test-limited", "mBTC100", true)
+	expect("test-limited", "mBTC0.5", false)
+	expect("test-limited", "mBTC100.5", false)
+	expect("test-limited", "mBTC1.2", false)
+	// Articles without limits accept any price
+	expect("test-unlimited", "mBTC3.3", true)
+
+	// An invalid configuration is reported as such, not as an invalid price
+	if err := checkPrice("test-misconfigured", money.Money{Currency: money.BTC, Amount: 1}); err == nil {
+		t.Errorf("Expected an invalid minimum price to be reported")
+	} else if _, ok := err.(*apiError); ok {
+		t.Errorf("Expected an invalid minimum price not to be blamed on the bid, got: %v", err)
+	}
+}
@@ -53,6 +53,9 @@ const bidCreateHtml = `
 <input id="typesell" type="radio" name="type" value="SELL"  onchange="update()"/>Sell
 <input id="price" type="text" name="price" value="mBTC 1.00" onchange="update()"/> &larr; Max/min price<br/>
 <input id="address" type="text" name="address" size="50" placeholder="Your account's Bitcoin address" onchange="update()"/>
+<input id="account" type="text" name="account" size="50" placeholder="Team account to bid for (optional)" onchange="update()"/>
+<input id="counterparty" type="text" name="counterparty" size="50" placeholder="Counterparty's address (optional)" onchange="update()"/>
+<input id="requestid" type="text" name="requestid" size="30" placeholder="Request ID (optional)" onchange="update()"/>
 <input id="nonce" type="hidden" name="nonce" onchange="update()"/> <br/>
 <input type="text" name="signature" size="80" placeholder="Signature of query parameters using above address" />
 <input type="submit" />
@@ -71,6 +74,12 @@ const bidViewHtml = `
 <table>
 <tr><th>Bid</th><td>{{.Id}}</td></tr>
 <tr><th>Participant</th><td><a href="/account/{{.Bid.Participant}}">{{.Bid.Participant}}</a></td></tr>
+{{if .Ext.Signer}}
+<tr><th>Signed by</th><td><a href="/account/{{.Ext.Signer}}">{{.Ext.Signer}}</a> (team member)</td></tr>
+{{end}}
+{{if .Ext.Counterparty}}
+<tr><th>Counterparty</th><td><a href="/account/{{.Ext.Counterparty}}">{{.Ext.Counterparty}}</a></td></tr>
+{{end}}
 <tr><th>Type</th><td>{{.Bid.Type}}</td></tr>
 <tr><th>Article</th><td>{{.Bid.Article}}</td></tr>
 <tr><th>Price</th><td>{{.Bid.Price}}</td></tr>
@@ -106,7 +115,7 @@ func handleRenderBid(w http.ResponseWriter, r *http.Request) {
 		}
 
 		c := appengine.NewContext(r)
-		bid, err := db.GetBid(c, bidId)
+		bid, ext, err := db.GetBid(c, bidId)
 		if err != nil {
 			http.Error(w, "Bid not found: "+bidId, http.StatusNotFound)
 			log.Warningf(c, "Non-existing bid queried: '%v'", bidId)
@@ -125,9 +134,9 @@ func handleRenderBid(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("ETag", etag)
 		w.Header().Set("Content-Type", contentType)
 		if contentType == "application/json" {
-			err = renderBidJson(w, bidId, bid)
+			err = renderBidJson(w, bidId, bid, ext)
 		} else {
-			err = renderBidHtml(w, bidId, bid)
+			err = renderBidHtml(w, bidId, bid, ext)
 		}
 
 		if err != nil {
@@ -154,7 +163,7 @@ func handleCreateBid(w http.ResponseWriter, r *http.Request) {
 		log.Infof(c, "Bid: %v", r.PostForm)
 		if err := enqueueBid(c, w, r); err != nil {
 			log.Errorf(c, "enqueueBid failed: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeLegacyError(w, err.Error(), err)
 			return
 		}
 	} else {
@@ -164,67 +173,197 @@ func handleCreateBid(w http.ResponseWriter, r *http.Request) {
 
 // The server's set of defaults for new bids:
 //  - State is InQueue
-//  - Fee is 3 percent
+//  - Fee is the higher of the article's maker and taker fees
 //  - Created is time.Now()
 //  - Exprires is 120s from now
-var newBidDefaults = bitwrk.NewBidDefaults{
-	InitialState:        bitwrk.InQueue,
-	FeeRatioNumerator:   3,
-	FeeRatioDenominator: 100,
-	Timeout:             120 * time.Second,
+func newBidDefaults(article string) *bitwrk.NewBidDefaults {
+	return &bitwrk.NewBidDefaults{
+		InitialState:        bitwrk.InQueue,
+		FeeRatioNumerator:   config.GetArticleSettings(article).MaxFeeBasisPoints(),
+		FeeRatioDenominator: 10000,
+		Timeout:             120 * time.Second,
+	}
+}
+
+func enqueueBid(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	bidKey, bid, created, err := createBid(c, r.Form, r.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	// Send headers to client. A repeated request is redirected to the original bid.
+	redirectToBid(bidKey, w, r)
+
+	// Trigger batch processing
+	if !created {
+		log.Infof(c, "Bid request repeated, returning existing bid %v", bidKey)
+	} else if err := db.TriggerBatchProcessing(c, bid.Article, bid.MatchKey()); err != nil {
+		log.Errorf(c, "Batch processing bids failed: %v", err)
+	}
+
+	return nil
 }
 
-func enqueueBid(c context.Context, w http.ResponseWriter, r *http.Request) (err error) {
-	bidType := r.FormValue("type")
-	bidArticle := r.FormValue("article")
-	bidPrice := r.FormValue("price")
-	bidAddress := strings.TrimSpace(r.FormValue("address"))
-	bidNonce := r.FormValue("nonce")
-	bidSignature := r.FormValue("signature")
+// Maximum length of the optional, client-supplied request ID of a bid
+const maxRequestIdLength = 64
 
+// Request IDs consist of letters, digits, '-' and '_'.
+func checkRequestId(requestId string) error {
+	if len(requestId) > maxRequestIdLength {
+		return fmt.Errorf("Request ID may not exceed %v characters", maxRequestIdLength)
+	}
+	for _, r := range requestId {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("Request ID contains invalid character %q", r)
+		}
+	}
+	return nil
+}
+
+// Checks the version of the BitWrk client identified by userAgent against the
+// oldest version allowed for the article. Other user agents are not checked.
+func checkClientVersion(userAgent, article string) error {
+	minVersionStr := config.GetArticleSettings(article).MinClientVersion
+	if minVersionStr == "" {
+		return nil
+	}
+	version, ok := util.ClientVersionFromUserAgent(userAgent)
+	if !ok {
+		return nil
+	}
+	if minVersion, err := util.ParseClientVersion(minVersionStr); err != nil {
+		return fmt.Errorf("Invalid minimum client version configured for article %v: %v", article, err)
+	} else if version.Less(minVersion) {
+		return clientOutdated(version, minVersion, article)
+	}
+	return nil
+}
+
+// Verifies and enqueues a bid given by its request parameters. Validation failures
+// are returned as *apiError. If the bid repeats an earlier request (identified by
+// parameter "requestid"), the bid created for that request is returned and created
+// is false.
+func createBid(c context.Context, values url.Values, userAgent string) (bidKey *datastore.Key, bid *bitwrk.Bid, created bool, err error) {
 	// Important: checking (and invalidating) the nonce must be the first thing we do!
-	err = checkNonce(c, bidNonce)
+	nonce, err := useNonce(c, values.Get("nonce"))
 	if config.CfgRequireValidNonce && err != nil {
-		return fmt.Errorf("Error in checkNonce: %v", err)
+		return nil, nil, false, nonceError(err)
 	}
 
-	err = util.CheckArticle(c, bidArticle)
+	bid, ext, err := prepareBid(c, values, userAgent)
 	if err != nil {
-		return
+		return nil, nil, false, err
+	}
+	if nonce != nil {
+		ext.RemoteAddr = nonce.RemoteAddr
 	}
 
-	err = util.CheckBitcoinAddress(bidAddress)
+	bidKey, created, err = db.EnqueueBid(c, bid, ext)
 	if err != nil {
-		return
+		return nil, nil, false, err
+	}
+
+	return bidKey, bid, created, nil
+}
+
+// Parses and verifies a bid given by its request parameters, except for the nonce,
+// which must have been checked by the caller. Returns the bid along with its
+// server-side extension. Validation failures are returned as *apiError.
+func prepareBid(c context.Context, values url.Values, userAgent string) (*bitwrk.Bid, *db.BidExtension, error) {
+	bidType := values.Get("type")
+	bidArticle := values.Get("article")
+	bidPrice := values.Get("price")
+	bidAddress := strings.TrimSpace(values.Get("address"))
+	bidNonce := values.Get("nonce")
+	bidSignature := values.Get("signature")
+	bidAccount := strings.TrimSpace(values.Get("account"))
+	bidCounterparty := strings.TrimSpace(values.Get("counterparty"))
+	bidRequestId := values.Get("requestid")
+
+	if err := util.CheckArticle(c, bidArticle); err != nil {
+		return nil, nil, badRequest("article", "%v", err)
+	}
+
+	if err := checkClientVersion(userAgent, bidArticle); err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkMarketOpen(c, bidArticle); err != nil {
+		return nil, nil, err
+	}
+
+	if err := util.CheckParticipantAddress(bidAddress); err != nil {
+		return nil, nil, badRequest("address", "%v", err)
+	}
+
+	// Team members bid on behalf of their team's account
+	participant := bidAddress
+	if bidAccount != "" && bidAccount != bidAddress {
+		if err := util.CheckParticipantAddress(bidAccount); err != nil {
+			return nil, nil, badRequest("account", "Invalid account: %v", err)
+		}
+		participant = bidAccount
+	}
+
+	var ext db.BidExtension
+	if bidCounterparty != "" {
+		if err := util.CheckParticipantAddress(bidCounterparty); err != nil {
+			return nil, nil, badRequest("counterparty", "Invalid counterparty: %v", err)
+		} else if bidCounterparty == participant {
+			return nil, nil, badRequest("counterparty", "Counterparty must be different from bid's participant")
+		}
+		ext.Counterparty = bidCounterparty
+	}
+
+	if err := checkRequestId(bidRequestId); err != nil {
+		return nil, nil, badRequest("requestid", "%v", err)
 	}
+	ext.RequestId = bidRequestId
 
 	bid, err := bitwrk.ParseBid(bidType, bidArticle, bidPrice, bidAddress, bidNonce, bidSignature,
-		&newBidDefaults)
+		newBidDefaults(bidArticle))
 	if err != nil {
-		return
+		return nil, nil, badRequest("", "%v", err)
+	}
+
+	if err := checkPrice(bidArticle, bid.Price); err != nil {
+		return nil, nil, err
+	}
+
+	// Additional parameters are part of the signed document, so they can't be tampered with.
+	if participant != bidAddress {
+		bid.Document += "&account=" + url.QueryEscape(participant)
+	}
+	if ext.Counterparty != "" {
+		bid.Document += "&counterparty=" + url.QueryEscape(ext.Counterparty)
+	}
+	if ext.RequestId != "" {
+		bid.Document += "&requestid=" + url.QueryEscape(ext.RequestId)
 	}
 
 	if config.CfgRequireValidSignature {
-		err = bid.Verify()
-		if err != nil {
-			return
+		if err := util.VerifySignature(bid.Document, bid.Participant, bid.Signature); err != nil {
+			return nil, nil, signatureError(err)
 		}
 	}
 
-	bidKey, err := db.EnqueueBid(c, bid)
-	if err != nil {
-		return fmt.Errorf("Error in db.EnqueueBid: %v", err)
+	// From now on, the bid belongs to the team. Whether the signer is actually a
+	// member is checked by db.EnqueueBid.
+	if participant != bidAddress {
+		ext.Signer = bid.Participant
+		bid.Participant = participant
 	}
 
-	// Send headers to client
-	redirectToBid(bidKey, w, r)
-
-	// Trigger batch processing
-	if err := db.TriggerBatchProcessing(c, bid.MatchKey()); err != nil {
-		log.Errorf(c, "Batch processing bids failed: %v", err)
+	if err := checkNotSuspended(c, bid.Participant); err != nil {
+		return nil, nil, err
+	}
+	if ext.Signer != "" {
+		if err := checkNotSuspended(c, ext.Signer); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return
+	return bid, &ext, nil
 }
 
 func redirectToBid(bidKey *datastore.Key, w http.ResponseWriter, r *http.Request) {
@@ -235,14 +374,18 @@ func redirectToBid(bidKey *datastore.Key, w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusSeeOther)
 }
 
-func renderBidHtml(w http.ResponseWriter, bidId string, bid *bitwrk.Bid) (err error) {
+func renderBidHtml(w http.ResponseWriter, bidId string, bid *bitwrk.Bid, ext *db.BidExtension) (err error) {
 	type context struct {
 		Id  string
 		Bid *bitwrk.Bid
+		Ext *db.BidExtension
 	}
-	return bidViewTemplate.Execute(w, context{bidId, bid})
+	return bidViewTemplate.Execute(w, context{bidId, bid, ext})
 }
 
-func renderBidJson(w http.ResponseWriter, bidId string, bid *bitwrk.Bid) (err error) {
-	return json.NewEncoder(w).Encode(*bid)
+func renderBidJson(w http.ResponseWriter, bidId string, bid *bitwrk.Bid, ext *db.BidExtension) (err error) {
+	return json.NewEncoder(w).Encode(struct {
+		bitwrk.Bid
+		db.BidExtension
+	}{*bid, *ext})
 }
@@ -97,6 +97,10 @@ func handleCreateDeposit(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if r.Method == "POST" {
 		c := appengine.NewContext(r)
+		if err := checkMaintenance(c); err != nil {
+			writeLegacyError(w, err.Error(), err)
+			return
+		}
 		depositType := r.FormValue("type")
 		depositAccount := r.FormValue("account")
 		depositAmount := r.FormValue("amount")
@@ -123,7 +127,7 @@ func createDeposit(c context.Context, depositType, depositAccount, depositAmount
 	}
 
 	// Bitcoin addresses must have the right network id
-	err = util.CheckBitcoinAddress(depositAccount)
+	err = util.CheckParticipantAddress(depositAccount)
 	if err != nil {
 		return
 	}
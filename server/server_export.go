@@ -0,0 +1,146 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	db "github.com/indyjo/bitwrk/server/gae"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// Maximum size of an import request (App Engine doesn't accept larger requests anyway)
+const maxImportRequestSize = 32 * 1024 * 1024
+
+// Number of records written to the datastore at once (App Engine's limit for PutMulti)
+const importBatchSize = 500
+
+// Handler function for /admin/export. Exports up to "limit" entities of the kind given
+// by "kind" as JSON Lines, one entity per line. If there are more entities, the cursor
+// to continue with is returned in header X-Export-Cursor and must be passed as
+// parameter "cursor" to the next request. Admin-only.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !user.IsAdmin(c) {
+		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	if kind == "" {
+		http.Error(w, "kind argument missing, must be one of: "+strings.Join(db.ExportKinds, ", "), http.StatusNotFound)
+		return
+	}
+
+	limit := db.MaxExportBatchSize
+	if limitStr := r.FormValue("limit"); limitStr == "" {
+	} else if n, err := strconv.Atoi(limitStr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else {
+		limit = n
+	}
+
+	// The cursor must be known before writing the response, so records are collected first
+	records := make([]*db.ExportRecord, 0, 64)
+	cursor, err := db.ExportEntities(c, kind, r.FormValue("cursor"), limit, func(record *db.ExportRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		log.Errorf(c, "Error exporting %v: %v", kind, err)
+		http.Error(w, "Error exporting: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if cursor != "" {
+		w.Header().Set("X-Export-Cursor", cursor)
+	}
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			log.Errorf(c, "Error writing export: %v", err)
+			return
+		}
+	}
+	log.Infof(c, "Exported %v entities of kind %v", len(records), kind)
+}
+
+// Handler function for /admin/import. Reads entities in the JSON Lines format written
+// by /admin/export from the request body and stores them, replacing entities with the
+// same keys. Admin-only.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if !user.IsAdmin(c) {
+		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportRequestSize))
+	decoder.UseNumber()
+
+	count := 0
+	batch := make([]db.ExportRecord, 0, importBatchSize)
+	flush := func() error {
+		if err := db.ImportEntities(c, batch); err != nil {
+			return fmt.Errorf("Error importing records %v to %v: %v", count, count+len(batch)-1, err)
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		var record db.ExportRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding record %v: %v", count+len(batch), err), http.StatusBadRequest)
+			return
+		}
+		batch = append(batch, record)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				log.Errorf(c, "%v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			log.Errorf(c, "%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Infof(c, "Imported %v entities", count)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Imported %v entities\n", count)
+}
@@ -0,0 +1,170 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/indyjo/bitwrk-common/bitwrk"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const haltHtml = `
+<!doctype html>
+<html>
+<head><title>Market Halts</title></head>
+<script src="/js/createmessage.js" ></script>
+<script src="/js/getnonce.js" ></script>
+<body onload="getnonce()">
+<h1>Market Halts</h1>
+<table>
+<tr><th>Scope</th><th>Since</th><th>Reason</th><th>Paused</th></tr>
+{{range .}}
+<tr><td>{{.Scope}}</td><td>{{.Since}}</td><td>{{.Reason}}</td><td>{{len .Paused}}</td></tr>
+{{else}}
+<tr><td colspan="4">Trading is not halted.</td></tr>
+{{end}}
+</table>
+<h2>Halt or resume</h2>
+<form action="/halt" method="post" onchange="updateHalt()">
+<select id="action" name="action"><option>halt</option><option>resume</option></select><br/>
+<input id="scope" type="text" name="scope" placeholder="Article, or * for maintenance of the whole market" size="50" /><br/>
+<input id="reason" type="text" name="reason" placeholder="Reason, shown to users" size="80" /><br/>
+<input id="nonce" type="hidden" name="nonce" onchange="updateHalt()"/>
+<input type="text" name="signature" size="80" placeholder="Signature of query using the admin account" />
+<input type="submit" />
+</form>
+Sign this text using the admin account to confirm:<br />
+<input id="query" type="text" size="100" value="" onclick="select()" readonly/>
+<script>
+function updateHalt() {
+    var q = "";
+    // Arguments must appear in alphabetical order
+    q = append(q, "action");
+    q = append(q, "nonce");
+    q = appendText(q, "reason");
+    q = append(q, "scope");
+    document.getElementById("query").value = q;
+}
+</script>
+</body>
+</html>
+`
+
+var haltTemplate = template.Must(template.New("halt").Parse(haltHtml))
+
+// Returns the error reported for requests rejected because of a halt.
+func haltError(halt *db.Halt) *apiError {
+	if halt.IsMaintenance() {
+		return &apiError{http.StatusServiceUnavailable, "maintenance",
+			fmt.Sprintf("The market is in maintenance mode: %v", halt.Reason), "", nil}
+	}
+	return &apiError{http.StatusServiceUnavailable, "market_halted",
+		fmt.Sprintf("Trading in article %v is halted: %v", halt.Scope, halt.Reason), "", nil}
+}
+
+// Returns an error if bids for the article are not accepted, because trading in
+// the article is halted or the market is in maintenance mode.
+func checkMarketOpen(c context.Context, article string) error {
+	if halt, err := db.GetHalt(c, article); err != nil {
+		return err
+	} else if halt != nil {
+		return haltError(halt)
+	}
+	return nil
+}
+
+// Returns an error if the market is in maintenance mode, in which requests
+// changing accounts are rejected. Transaction messages are still accepted.
+func checkMaintenance(c context.Context) error {
+	return checkMarketOpen(c, db.MaintenanceScope)
+}
+
+// Handler function for /halt. GET lists the halts in force and offers a form for
+// halting and resuming trading. POST halts or resumes trading, as signed by the admin.
+func handleHalt(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		if err := updateHalt(c, r); err != nil {
+			log.Warningf(c, "updateHalt failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Redirect(w, r, "/halt", http.StatusSeeOther)
+		}
+	} else if r.Method == "GET" {
+		if halts, err := db.QueryHalts(c); err != nil {
+			log.Errorf(c, "Error querying halts: %v", err)
+			http.Error(w, "Error querying halts", http.StatusInternalServerError)
+		} else if err := haltTemplate.Execute(w, halts); err != nil {
+			http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
+		}
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Halts or resumes trading in an article, or in the whole market if the scope is "*".
+// Matching skipped during the halt is triggered after resuming.
+func updateHalt(c context.Context, r *http.Request) error {
+	values, document, signature, err := parseAdminRequest(c, r)
+	if err != nil {
+		return err
+	}
+
+	scope := values["scope"]
+	if scope != db.MaintenanceScope {
+		if err := util.CheckArticle(c, scope); err != nil {
+			return err
+		}
+	}
+
+	switch action := values["action"]; action {
+	case "halt":
+		if values["reason"] == "" {
+			return fmt.Errorf("A reason must be given")
+		}
+		log.Infof(c, "Halting %v: %v", scope, values["reason"])
+		return db.SetHalt(c, &db.Halt{
+			Scope:     scope,
+			Reason:    values["reason"],
+			Since:     time.Now(),
+			Document:  document,
+			Signature: signature,
+		})
+	case "resume":
+		log.Infof(c, "Resuming %v", scope)
+		paused, err := db.LiftHalt(c, scope)
+		if err != nil {
+			return err
+		}
+		for _, p := range paused {
+			if err := db.TriggerBatchProcessing(c, bitwrk.ArticleId(p.Article), p.MatchKey); err != nil {
+				log.Errorf(c, "Batch processing bids failed: %v", err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("Invalid action: %#v", action)
+	}
+}
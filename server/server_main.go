@@ -28,25 +28,49 @@ import (
 )
 
 func init() {
-	http.HandleFunc("/login", handleLogin)
-	http.HandleFunc("/logout", handleLogout)
-	http.HandleFunc("/bid", handleCreateBid)
-	http.HandleFunc("/bid/", handleRenderBid)
-	http.HandleFunc("/nonce", handleGetNonce)
-	http.HandleFunc("/tx/", handleTx)
-	http.HandleFunc("/account/", handleAccount)
-	http.HandleFunc("/ledger/", handleAccountMovement)
-	http.HandleFunc("/myip", handleMyIp)
-	http.HandleFunc("/motd", handleMessageOfTheDay)
-	http.HandleFunc("/deposit", handleCreateDeposit)
-	http.HandleFunc("/deposit/", handleRenderDeposit)
-	http.HandleFunc("/query/accounts", query.HandleQueryAccounts)
-	http.HandleFunc("/query/ledger", query.HandleQueryAccountMovements)
-	http.HandleFunc("/query/prices", query.HandleQueryPrices)
-	http.HandleFunc("/query/trades", query.HandleQueryTrades)
-	http.HandleFunc("/_ah/queue/apply-changes", handleApplyChanges)
-	http.HandleFunc("/_ah/queue/retire-tx", handleRetireTransaction)
-	http.HandleFunc("/_ah/queue/retire-bid", handleRetireBid)
+	handleFunc("/login", handleLogin)
+	handleFunc("/logout", handleLogout)
+	handleFunc("/bid", handleCreateBid)
+	handleFunc("/bid/", handleRenderBid)
+	handleFunc("/nonce", handleGetNonce)
+	handleFunc("/tx/", handleTx)
+	handleFunc("/account/", handleAccount)
+	handleFunc("/team", handleTeam)
+	handleFunc("/ledger/", handleAccountMovement)
+	handleFunc("/myip", handleMyIp)
+	handleFunc("/motd", handleMessageOfTheDay)
+	handleFunc("/motd/edit", handleEditMotd)
+	handleFunc("/halt", handleHalt)
+	handleFunc("/suspension", handleSuspension)
+	handleFunc("/admin/export", handleExport)
+	handleFunc("/admin/import", handleImport)
+	handleFunc("/admin/aggregate-prices", handleScheduleAggregations)
+	handleFunc("/admin/reindex", handleReindex)
+	handleFunc("/deposit", handleCreateDeposit)
+	handleFunc("/deposit/", handleRenderDeposit)
+	handleFunc("/query/accounts", query.HandleQueryAccounts)
+	handleFunc("/query/ledger", query.HandleQueryAccountMovements)
+	handleFunc("/query/prices", query.HandleQueryPrices)
+	handleFunc("/query/trades", query.HandleQueryTrades)
+	handleFunc("/query/public-trades", query.HandleQueryPublicTrades)
+	handleFunc("/query/fees", query.HandleQueryFees)
+	handleFunc("/query/suspicious", query.HandleQuerySuspicious)
+	handleFunc("/metrics", handleMetrics)
+	handleFunc("/v2/nonce", handleApiNonce)
+	handleFunc("/v2/bid", handleApiBid)
+	handleFunc("/v2/bid/", handleApiBid)
+	handleFunc("/v2/bids", handleApiBids)
+	handleFunc("/v2/tx/", handleApiTx)
+	handleFunc("/v2/account/", handleApiAccount)
+	handleFunc("/v2/article/", handleApiArticle)
+	handleFunc("/_ah/queue/apply-changes", handleApplyChanges)
+	handleFunc("/_ah/queue/retire-tx", handleRetireTransaction)
+	handleFunc("/_ah/queue/retire-bid", handleRetireBid)
+	handleFunc("/_ah/queue/collect-fee", handleCollectFee)
+	handleFunc("/_ah/queue/settle-dispute", handleSettleDispute)
+	handleFunc("/_ah/queue/aggregate-price", handleAggregatePrice)
+	handleFunc("/_ah/cron/detect-suspicious", handleDetectSuspicious)
+	handleFunc("/_ah/cron/archive", handleArchive)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -94,8 +118,7 @@ func handleMyIp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addr := r.RemoteAddr
-	stripped := util.StripPort(addr)
-	log.Infof(r.Context(), "Got MYIP request from '%v', returning '%v'", addr, stripped)
-	w.Write([]byte(stripped))
+	addr := util.ClientAddr(r)
+	log.Infof(r.Context(), "Got MYIP request from '%v', returning '%v'", r.RemoteAddr, addr)
+	w.Write([]byte(addr))
 }
@@ -0,0 +1,90 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/indyjo/bitwrk/server/config"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/metrics"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// How often each instance adds the metric increments it collected to the datastore
+const metricsFlushInterval = 10 * time.Second
+
+// Registers a handler function with the default mux. Once the handler has finished,
+// metric increments collected by the instance are stored if they are due.
+func handleFunc(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r)
+		if metrics.Due(time.Now(), metricsFlushInterval) {
+			c := appengine.NewContext(r)
+			if err := db.FlushMetrics(c); err != nil {
+				log.Warningf(c, "Storing metrics failed: %v", err)
+			}
+		}
+	})
+}
+
+// Returns whether the request carries the configured metrics bearer token. Always false
+// if no token is configured.
+func hasMetricsToken(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if config.CfgMetricsToken == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	token := strings.TrimPrefix(auth, prefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.CfgMetricsToken)) == 1
+}
+
+// Handler function for /metrics. Renders the totals of all instances. Requires the
+// bearer token configured as CfgMetricsToken, so that a scraper can access it.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !hasMetricsToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Valid metrics token required", http.StatusUnauthorized)
+		return
+	}
+
+	c := appengine.NewContext(r)
+
+	if err := db.FlushMetrics(c); err != nil {
+		log.Warningf(c, "Storing metrics failed: %v", err)
+	}
+	totals, err := db.LoadMetrics(c)
+	if err != nil {
+		log.Errorf(c, "Loading metrics failed: %v", err)
+		http.Error(w, "Error loading metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-cache")
+	metrics.WriteText(w, totals)
+}
@@ -0,0 +1,51 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/indyjo/bitwrk/server/config"
+)
+
+func TestHasMetricsToken(t *testing.T) {
+	defer func(token string) { config.CfgMetricsToken = token }(config.CfgMetricsToken)
+
+	expect := func(authorization string, expected bool) {
+		r, _ := http.NewRequest("GET", "/metrics", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		if actual := hasMetricsToken(r); actual != expected {
+			t.Errorf("Expected: hasMetricsToken(%#v) = %v with token %#v  --  Got: %v",
+				authorization, expected, config.CfgMetricsToken, actual)
+		}
+	}
+
+	// No token configured: nobody gets in
+	config.CfgMetricsToken = ""
+	expect("", false)
+	expect("Bearer ", false)
+
+	config.CfgMetricsToken = "s3cret"
+	expect("Bearer s3cret", true)
+	expect("", false)
+	expect("s3cret", false)
+	expect("Bearer s3cre", false)
+	expect("Basic s3cret", false)
+}
@@ -1,5 +1,5 @@
 //  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
-//  Copyright (C) 2014-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
 //
 //  This program is free software: you can redistribute it and/or modify
 //  it under the terms of the GNU General Public License as published by
@@ -17,21 +17,115 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
 	"regexp"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/indyjo/bitwrk/server/config"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
 )
 
 type motd struct {
 	Text    string
 	Warning bool
+	Error   bool         `json:",omitempty"`
+	Success bool         `json:",omitempty"`
+	Notices []motdNotice `json:",omitempty"`
+}
+
+// A message concerning a single article
+type motdNotice struct {
+	Article  string
+	Text     string
+	Severity string
+}
+
+const motdEditHtml = `
+<!doctype html>
+<html>
+<head><title>Messages of the Day</title></head>
+<script src="/js/createmessage.js" ></script>
+<script src="/js/getnonce.js" ></script>
+<body onload="getnonce()">
+<h1>Messages of the Day</h1>
+<table>
+<tr><th>Id</th><th>Severity</th><th>Versions</th><th>Valid</th><th>Article</th><th>Text</th></tr>
+{{range .}}
+<tr><td>{{.Id}}</td><td>{{.Severity}}</td><td>{{.MinVersion}} - {{.MaxVersion}}</td><td>{{.ValidFrom}} - {{.ValidUntil}}</td><td>{{.Article}}</td><td>{{.Text}}</td></tr>
+{{end}}
+</table>
+<h2>Edit</h2>
+<form action="/motd" method="post" onchange="updateMotd()">
+<select id="action" name="action"><option>save</option><option>delete</option></select><br/>
+<input id="id" type="text" name="id" placeholder="Id" /><br/>
+<select id="severity" name="severity"><option>info</option><option>success</option><option>warning</option><option>error</option></select><br/>
+<input id="minversion" type="text" name="minversion" placeholder="Minimum client version, e.g. 0.6.0 (optional)" size="40" /><br/>
+<input id="maxversion" type="text" name="maxversion" placeholder="Maximum client version (optional)" size="40" /><br/>
+<input id="validfrom" type="text" name="validfrom" placeholder="Valid from, e.g. 2019-01-31T12:00:00Z (optional)" size="40" /><br/>
+<input id="validuntil" type="text" name="validuntil" placeholder="Valid until (optional)" size="40" /><br/>
+<input id="article" type="text" name="article" placeholder="Article (optional)" size="40" /><br/>
+<textarea id="text" name="text" rows="3" cols="80" placeholder="Text (HTML)"></textarea><br/>
+<input id="nonce" type="hidden" name="nonce" onchange="updateMotd()"/>
+<input type="text" name="signature" size="80" placeholder="Signature of query using the admin account" />
+<input type="submit" />
+</form>
+Sign this text using the admin account {{/* */}}to confirm:<br />
+<input id="query" type="text" size="100" value="" onclick="select()" readonly/>
+<script>
+function updateMotd() {
+    var q = "";
+    // Arguments must appear in alphabetical order
+    q = append(q, "action");
+    q = append(q, "article");
+    q = append(q, "id");
+    q = append(q, "maxversion");
+    q = append(q, "minversion");
+    q = append(q, "nonce");
+    q = append(q, "severity");
+    q = appendText(q, "text");
+    q = append(q, "validfrom");
+    q = append(q, "validuntil");
+    document.getElementById("query").value = q;
 }
+</script>
+</body>
+</html>
+`
+
+var motdEditTemplate = template.Must(template.New("motdEdit").Parse(motdEditHtml))
 
-// Handler for the /motd URL path. Returns a JSON document containing a message for the user.
+// Handler for the /motd URL path. GET returns a JSON document containing a message
+// for the user. POST creates, replaces or deletes a message, as signed by the admin.
 func handleMessageOfTheDay(w http.ResponseWriter, r *http.Request) {
-	m := getMessageOfTheDay(r)
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		if err := storeMotd(c, r); err != nil {
+			log.Warningf(c, "storeMotd failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Redirect(w, r, "/motd/edit", http.StatusSeeOther)
+		}
+		return
+	} else if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := getMessageOfTheDay(c, r, time.Now())
+	if err != nil {
+		log.Errorf(c, "Error getting motd: %v", err)
+		http.Error(w, "Error getting motd", http.StatusInternalServerError)
+		return
+	}
 
 	bytes, err := json.Marshal(m)
 	if err != nil {
@@ -42,32 +136,205 @@ func handleMessageOfTheDay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-var uaRegexp = regexp.MustCompile("^BitWrkGoClient/([0-9]{1,4})\\.([0-9]{1,4})\\.([0-9]{1,4})")
+// Handler for /motd/edit. Lists all messages and offers a form for editing them.
+func handleEditMotd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-// Returns a message based on analyzing the HTTP "User-Agent" header.
-func getMessageOfTheDay(r *http.Request) motd {
-	ua := r.Header.Get("User-Agent")
-	matches := uaRegexp.FindStringSubmatch(ua)
-	if matches == nil {
-		return motd{"Welcome to the BitWrk network, stranger!", false}
+	c := appengine.NewContext(r)
+	if entries, err := db.QueryMotds(c); err != nil {
+		log.Errorf(c, "Error querying motds: %v", err)
+		http.Error(w, "Error querying messages", http.StatusInternalServerError)
+	} else if err := motdEditTemplate.Execute(w, entries); err != nil {
+		http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
 	}
+}
 
-	major, _ := strconv.ParseInt(matches[1], 10, 16)
-	minor, _ := strconv.ParseInt(matches[2], 10, 16)
-	micro, _ := strconv.ParseInt(matches[3], 10, 16)
+// Orders severities, from least to most severe
+var motdSeverities = map[string]int{
+	db.SeverityInfo:    0,
+	db.SeveritySuccess: 1,
+	db.SeverityWarning: 2,
+	db.SeverityError:   3,
+}
 
-	const currentMajor = 0
-	const currentMinor = 6
-	const currentMicro = 4
+// Returns whether a message is meant for the given client version. Messages
+// restricted to certain versions are not shown to unknown clients.
+func motdMatchesVersion(entry *db.MotdEntry, version util.ClientVersion, known bool) bool {
+	if entry.MinVersion == "" && entry.MaxVersion == "" {
+		return true
+	} else if !known {
+		return false
+	}
+	if min, err := util.ParseClientVersion(entry.MinVersion); err == nil && version.Less(min) {
+		return false
+	}
+	if max, err := util.ParseClientVersion(entry.MaxVersion); err == nil && max.Less(version) {
+		return false
+	}
+	return true
+}
 
-	if major > currentMajor || major == currentMajor && (minor > currentMinor || minor == currentMinor && micro >= currentMicro) {
-		return motd{fmt.Sprintf("Welcome to the BitWrk network!"+
-			" Your client is up to date (version %d.%d.%d).", major, minor, micro), false}
-	} else {
-		return motd{fmt.Sprintf("BitWrk proudly announces version %v.%v.%v!"+
-			" You are currently running client version %d.%d.%d."+
-			" For information on what's new and how to upgrade please visit"+
-			" <a target=\"_blank\" href=\"https://bitwrk.net/\">bitwrk.net</a>.",
-			currentMajor, currentMinor, currentMicro, major, minor, micro), true}
+// Returns the messages applying to the client, based on analyzing the HTTP
+// "User-Agent" header. General messages are combined into one text, the most severe
+// first. Messages concerning a single article are returned as notices, as are halts
+// of trading in an article. Maintenance of the whole market is announced as an error.
+func getMessageOfTheDay(c context.Context, r *http.Request, now time.Time) (motd, error) {
+	version, known := util.ClientVersionFromUserAgent(r.Header.Get("User-Agent"))
+
+	entries, err := db.QueryMotds(c)
+	if err != nil {
+		return motd{}, err
+	}
+
+	general := make([]db.MotdEntry, 0, len(entries))
+	var result motd
+	for _, entry := range entries {
+		if !entry.ValidAt(now) || !motdMatchesVersion(&entry, version, known) {
+			continue
+		}
+		if entry.Article != "" {
+			result.Notices = append(result.Notices, motdNotice{entry.Article, entry.Text, entry.Severity})
+		} else {
+			general = append(general, entry)
+		}
 	}
+
+	// Halts of trading are always announced
+	halts, err := db.QueryHalts(c)
+	if err != nil {
+		return motd{}, err
+	}
+	for _, halt := range halts {
+		text := haltError(&halt).Message
+		if halt.IsMaintenance() {
+			general = append(general, db.MotdEntry{Text: template.HTMLEscapeString(text), Severity: db.SeverityError})
+		} else {
+			result.Notices = append(result.Notices, motdNotice{halt.Scope, template.HTMLEscapeString(text), db.SeverityError})
+		}
+	}
+
+	if len(general) == 0 {
+		if known {
+			result.Text = fmt.Sprintf("Welcome to the BitWrk network! You are running client version %v.", version)
+		} else {
+			result.Text = "Welcome to the BitWrk network, stranger!"
+		}
+		return result, nil
+	}
+
+	sort.SliceStable(general, func(i, j int) bool {
+		return motdSeverities[general[i].Severity] > motdSeverities[general[j].Severity]
+	})
+	texts := make([]string, len(general))
+	for i, entry := range general {
+		texts[i] = entry.Text
+	}
+	result.Text = strings.Join(texts, "<br/>")
+	switch general[0].Severity {
+	case db.SeverityError:
+		result.Error = true
+	case db.SeverityWarning:
+		result.Warning = true
+	case db.SeveritySuccess:
+		result.Success = true
+	}
+	return result, nil
+}
+
+var motdIdRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]{1,64}$")
+
+// Parses and verifies a request signed by the admin account. The request's parameters,
+// except for the signature and empty ones, form the document that the admin signs.
+// Returns the parameters along with the document and its signature.
+func parseAdminRequest(c context.Context, r *http.Request) (values map[string]string, document, signature string, err error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, "", "", err
+	}
+
+	values = make(map[string]string)
+	for k, v := range r.PostForm {
+		if len(v) > 1 {
+			return nil, "", "", fmt.Errorf("Multiple occurrences of argument %#v", k)
+		} else if value := strings.TrimSpace(v[0]); value != "" && k != "signature" {
+			values[k] = value
+		}
+	}
+
+	// Important: checking (and invalidating) the nonce must be the first thing we do!
+	if err := checkNonce(c, values["nonce"]); config.CfgRequireValidNonce && err != nil {
+		return nil, "", "", fmt.Errorf("Error in checkNonce: %v", err)
+	}
+
+	document = makeDocument(values)
+	signature = r.PostForm.Get("signature")
+	if config.CfgRequireValidSignature {
+		if err := util.VerifySignature(document, config.CfgAdminAccount, signature); err != nil {
+			return nil, "", "", err
+		}
+	}
+	return values, document, signature, nil
+}
+
+// Creates, replaces or deletes a message of the day, as signed by the admin.
+func storeMotd(c context.Context, r *http.Request) error {
+	values, document, signature, err := parseAdminRequest(c, r)
+	if err != nil {
+		return err
+	}
+
+	id := values["id"]
+	if !motdIdRegexp.MatchString(id) {
+		return fmt.Errorf("Invalid id: %#v", id)
+	}
+
+	if action := values["action"]; action == "delete" {
+		return db.DeleteMotd(c, id)
+	} else if action != "save" {
+		return fmt.Errorf("Invalid action: %#v", action)
+	}
+
+	entry := db.MotdEntry{
+		Id:         id,
+		Text:       values["text"],
+		Severity:   values["severity"],
+		MinVersion: values["minversion"],
+		MaxVersion: values["maxversion"],
+		Article:    values["article"],
+		Updated:    time.Now(),
+		Document:   document,
+		Signature:  signature,
+	}
+
+	if entry.Text == "" {
+		return fmt.Errorf("Text must not be empty")
+	} else if _, ok := motdSeverities[entry.Severity]; !ok {
+		return fmt.Errorf("Invalid severity: %#v", entry.Severity)
+	}
+	for _, v := range []string{entry.MinVersion, entry.MaxVersion} {
+		if _, err := util.ParseClientVersion(v); v != "" && err != nil {
+			return err
+		}
+	}
+	if entry.Article != "" {
+		if err := util.CheckArticle(c, entry.Article); err != nil {
+			return err
+		}
+	}
+	for _, t := range []struct {
+		param string
+		dest  *time.Time
+	}{{"validfrom", &entry.ValidFrom}, {"validuntil", &entry.ValidUntil}} {
+		if s, ok := values[t.param]; !ok {
+			continue
+		} else if parsed, err := time.Parse(time.RFC3339, s); err != nil {
+			return fmt.Errorf("Invalid %v: %v", t.param, err)
+		} else {
+			*t.dest = parsed
+		}
+	}
+
+	return db.SaveMotd(c, &entry)
 }
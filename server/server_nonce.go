@@ -23,6 +23,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/indyjo/bitwrk/server/metrics"
+	"github.com/indyjo/bitwrk/server/util"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
@@ -46,6 +48,24 @@ func NonceKey(c context.Context, nonce string) *datastore.Key {
 // Handler function for /nonce
 func handleGetNonce(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+	nonce, err := issueNonce(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	// Make _really_ sure this is not cached
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+
+	w.Write([]byte(nonce))
+}
+
+// Creates and stores a new nonce on behalf of the requesting client.
+func issueNonce(c context.Context, r *http.Request) (string, error) {
 	hash := md5.New()
 	now := time.Now()
 
@@ -56,44 +76,52 @@ func handleGetNonce(w http.ResponseWriter, r *http.Request) {
 		now,
 		now.Add(180 * time.Second),
 		r.UserAgent(),
-		r.RemoteAddr}
+		util.ClientAddr(r)}
 
 	err := datastore.RunInTransaction(c, func(c context.Context) error {
 		_, err := datastore.Put(c, NonceKey(c, nonce), obj)
 		return err
 	}, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
 	}
-
-	w.Header().Set("Content-Type", "text/plain")
-
-	// Make _really_ sure this is not cached
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-
-	w.Write([]byte(nonce))
+	metrics.NoncesIssued.Inc()
 
 	// Delete expired nonces of a different shard
 	if err := deleteExpired(c, now, nonceShardKey(c, nonce[2:])); err != nil {
 		log.Warningf(c, "deleteExpired failed: %v", err)
 	}
+
+	return nonce, nil
 }
 
 var errInvalidNonce = fmt.Errorf("Nonce invalid")
 
 func checkNonce(c context.Context, nonce string) error {
+	_, err := useNonce(c, nonce)
+	return err
+}
+
+// Like checkNonce, but also returns the nonce's record, which tells whom the nonce
+// was issued to.
+func useNonce(c context.Context, nonce string) (*Nonce, error) {
+	dbNonce, err := consumeNonce(c, nonce)
+	if err == errInvalidNonce {
+		metrics.NoncesRejected.Inc()
+	}
+	return dbNonce, err
+}
+
+func consumeNonce(c context.Context, nonce string) (*Nonce, error) {
 	now := time.Now()
 
 	if len(nonce) < 24 || len(nonce) > 32 {
-		return errInvalidNonce
+		return nil, errInvalidNonce
 	}
 
 	key := NonceKey(c, nonce)
-	return datastore.RunInTransaction(c, func(c context.Context) error {
-		var dbNonce Nonce
+	var dbNonce Nonce
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
 		if err := datastore.Get(c, key, &dbNonce); err != nil {
 			return errInvalidNonce
 		}
@@ -108,6 +136,10 @@ func checkNonce(c context.Context, nonce string) error {
 
 		return nil
 	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dbNonce, nil
 }
 
 func deleteExpired(c context.Context, now time.Time, parentKey *datastore.Key) error {
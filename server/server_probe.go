@@ -0,0 +1,73 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/indyjo/bitwrk/server/metrics"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// Time allowed for a worker to answer the probe
+const workerProbeTimeout = 5 * time.Second
+
+// Maximum size of the capability document accepted from a worker
+const maxCapabilitiesSize = 4096
+
+// Sends an OPTIONS request to the worker URL announced by a seller. The worker is
+// expected to answer with its JSON capability document, as the client's
+// endpointReceiver does. Returns an *apiError if it doesn't.
+func probeWorkerURL(c context.Context, workerURL string) error {
+	if err := doProbeWorkerURL(c, workerURL); err != nil {
+		metrics.WorkerProbes.Inc("failed")
+		log.Warningf(c, "Probing worker at %v failed: %v", workerURL, err)
+		return workerUnreachable(workerURL, err)
+	}
+	metrics.WorkerProbes.Inc("ok")
+	return nil
+}
+
+func doProbeWorkerURL(c context.Context, workerURL string) error {
+	ctx, cancel := context.WithTimeout(c, workerProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodOptions, workerURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var capabilities map[string]interface{}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Worker answered with status %v", resp.Status)
+	} else if err := json.NewDecoder(io.LimitReader(resp.Body, maxCapabilitiesSize)).Decode(&capabilities); err != nil {
+		return fmt.Errorf("Invalid capability document: %v", err)
+	}
+	log.Infof(c, "Worker at %v is reachable, capabilities: %v", workerURL, capabilities)
+	return nil
+}
@@ -21,10 +21,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/indyjo/bitwrk/server/config"
 	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/metrics"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
 )
 
 func mustDecodeKey(s string) *datastore.Key {
@@ -50,12 +53,122 @@ func handleRetireTransaction(w http.ResponseWriter, r *http.Request) {
 		log.Infof(c, "Transaction is too young to be retired")
 	} else if err == db.ErrTransactionAlreadyRetired {
 		log.Infof(c, "Transaction has already been retired")
+	} else if err == db.ErrTransactionDisputed {
+		log.Infof(c, "Transaction is disputed")
 	} else if err != nil {
+		metrics.TaskFailures.Inc("retire-tx")
 		log.Warningf(c, "Error retiring transaction: %v", err)
 		http.Error(w, "Error retiring transaction", http.StatusInternalServerError)
 	}
 }
 
+func handleSettleDispute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	keyString := r.FormValue("tx")
+	key := mustDecodeKey(keyString)
+	log.Infof(c, "Settling overdue dispute of transaction %v (%v)", keyString, key)
+	if err := db.SettleOverdueDispute(c, key, time.Now()); err != nil {
+		metrics.TaskFailures.Inc("settle-dispute")
+		log.Warningf(c, "Error settling dispute: %v", err)
+		http.Error(w, "Error settling dispute", http.StatusInternalServerError)
+	}
+}
+
+func handleCollectFee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	keyString := r.FormValue("tx")
+	key := mustDecodeKey(keyString)
+	log.Infof(c, "Collecting fee of transaction %v (%v)", keyString, key)
+	if err := db.CollectFee(c, key); err != nil {
+		metrics.TaskFailures.Inc("collect-fee")
+		log.Warningf(c, "Error collecting fee: %v", err)
+		http.Error(w, "Error collecting fee", http.StatusInternalServerError)
+	}
+}
+
+func handleAggregatePrice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	keyString := r.FormValue("tx")
+	key := mustDecodeKey(keyString)
+	log.Infof(c, "Aggregating price of transaction %v (%v)", keyString, key)
+	if err := db.AggregatePrice(c, key); err != nil {
+		metrics.TaskFailures.Inc("aggregate-price")
+		log.Warningf(c, "Error aggregating price: %v", err)
+		http.Error(w, "Error aggregating price", http.StatusInternalServerError)
+	}
+}
+
+// Schedules aggregation of the prices of transactions created before price statistics
+// were kept, a batch at a time. Returns the cursor to pass as parameter "cursor" for the
+// next batch, which is empty when done. Admin-only.
+func handleScheduleAggregations(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if !user.IsAdmin(c) {
+		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
+		return
+	}
+
+	scheduled, cursor, err := db.ScheduleMissingAggregations(c, r.FormValue("cursor"), aggregationBatchSize)
+	if err != nil {
+		log.Errorf(c, "Error scheduling aggregations: %v", err)
+		http.Error(w, "Error scheduling aggregations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeApiJson(c, w, http.StatusOK, struct {
+		Scheduled int    `json:"scheduled"`
+		Cursor    string `json:"cursor"`
+	}{scheduled, cursor})
+}
+
+// Number of transactions looked at per call of handleScheduleAggregations
+const aggregationBatchSize = 500
+
+// Rewrites bids or transactions stored by older versions, so they are found by the
+// queries of suspensions. Like /admin/aggregate-prices, it is POSTed repeatedly with
+// the returned cursor, per kind, until the cursor is empty.
+func handleReindex(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if !user.IsAdmin(c) {
+		http.Error(w, "Action requires admin privileges", http.StatusForbidden)
+		return
+	}
+
+	count, cursor, err := db.ReindexEntities(c, r.FormValue("kind"), r.FormValue("cursor"), reindexBatchSize)
+	if err != nil {
+		log.Errorf(c, "Error reindexing: %v", err)
+		http.Error(w, "Error reindexing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeApiJson(c, w, http.StatusOK, struct {
+		Reindexed int    `json:"reindexed"`
+		Cursor    string `json:"cursor"`
+	}{count, cursor})
+}
+
+// Number of entities rewritten per call of handleReindex
+const reindexBatchSize = 100
+
 func handleRetireBid(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -67,6 +180,7 @@ func handleRetireBid(w http.ResponseWriter, r *http.Request) {
 	key := mustDecodeKey(keyString)
 	log.Infof(c, "Retiring bid %v (%v)", keyString, key)
 	if err := db.RetireBid(c, key); err != nil {
+		metrics.TaskFailures.Inc("retire-bid")
 		log.Warningf(c, "Error retiring bid: %v", err)
 		http.Error(w, "Error retiring bid", http.StatusInternalServerError)
 	}
@@ -87,6 +201,7 @@ func handleApplyChanges(w http.ResponseWriter, r *http.Request) {
 
 	for _, key := range placedKeys {
 		if err := db.PlaceBid(c, key); err != nil {
+			metrics.TaskFailures.Inc("apply-changes")
 			log.Errorf(c, "Couldn't place bid %v: %v", key, err)
 		}
 	}
@@ -98,6 +213,7 @@ func handleApplyChanges(w http.ResponseWriter, r *http.Request) {
 	}
 	var timestamp time.Time
 	if t, err := time.Parse(time.RFC3339Nano, r.FormValue("timestamp")); err != nil {
+		metrics.TaskFailures.Inc("apply-changes")
 		log.Errorf(c, "Couldn't parse time '%v': %v", r.FormValue("timestamp"), err)
 		return
 	} else {
@@ -108,7 +224,76 @@ func handleApplyChanges(w http.ResponseWriter, r *http.Request) {
 		newKey, oldKey := bidKeys[0], bidKeys[1]
 		bidKeys = bidKeys[2:]
 		if err := db.MatchBids(c, timestamp, newKey, oldKey); err != nil {
+			if refused, ok := err.(*db.MatchRefusedError); ok {
+				metrics.MatchesRefused.Inc()
+				log.Warningf(c, "Refused to match bids: %v", refused)
+				continue
+			}
+			metrics.TaskFailures.Inc("apply-changes")
 			log.Errorf(c, "Couldn't match bids %v and %v: %v", newKey, oldKey, err)
 		}
 	}
 }
+
+// Runs the wash-trade detector. Invoked periodically by cron (see cron.yaml).
+func handleDetectSuspicious(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Only cron may run the detector", http.StatusForbidden)
+		return
+	}
+
+	if n, err := db.DetectSuspiciousPairs(c, time.Now()); err != nil {
+		metrics.TaskFailures.Inc("detect-suspicious")
+		log.Errorf(c, "Error detecting suspicious pairs: %v", err)
+		http.Error(w, "Error detecting suspicious pairs", http.StatusInternalServerError)
+	} else if n > 0 {
+		log.Warningf(c, "Flagged %v suspicious transactions", n)
+	}
+}
+
+// Number of transactions archived, or bids scanned, per batch
+const archiveBatchSize = 100
+
+// Maximum number of batches processed per run, so the cron job finishes in time
+const maxArchiveBatches = 50
+
+// Archives old transactions and prunes old expired bids. Invoked daily by cron
+// (see cron.yaml). Each run continues where the previous one stopped.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Only cron may run archival", http.StatusForbidden)
+		return
+	}
+
+	cutoff := time.Now().Add(-config.CfgArchiveAfterDays * 24 * time.Hour)
+	archived, pruned := 0, 0
+	cursor := ""
+	for batch := 0; batch < maxArchiveBatches; batch++ {
+		n, next, err := db.ArchiveTransactions(c, cutoff, cursor, archiveBatchSize)
+		archived += n
+		if err != nil {
+			metrics.TaskFailures.Inc("archive")
+			log.Errorf(c, "Error archiving transactions: %v", err)
+			http.Error(w, "Error archiving transactions", http.StatusInternalServerError)
+			return
+		} else if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for batch := 0; batch < maxArchiveBatches; batch++ {
+		n, done, err := db.PruneExpiredBids(c, cutoff, archiveBatchSize)
+		pruned += n
+		if err != nil {
+			metrics.TaskFailures.Inc("archive")
+			log.Errorf(c, "Error pruning bids: %v", err)
+			http.Error(w, "Error pruning bids", http.StatusInternalServerError)
+			return
+		} else if done {
+			break
+		}
+	}
+	log.Infof(c, "Archived %v transactions and pruned %v bids older than %v", archived, pruned, cutoff)
+}
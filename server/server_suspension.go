@@ -0,0 +1,193 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const suspensionHtml = `
+<!doctype html>
+<html>
+<head><title>Suspensions</title></head>
+<script src="/js/createmessage.js" ></script>
+<script src="/js/getnonce.js" ></script>
+<body onload="getnonce()">
+<h1>Suspensions</h1>
+<table>
+<tr><th>Participant</th><th>Since</th><th>Until</th><th>Policy</th><th>Reason</th></tr>
+{{range .Suspensions}}
+<tr><td><a href="/suspension?participant={{.Participant}}">{{.Participant}}</a></td><td>{{.Since}}</td><td>{{if .Until.IsZero}}indefinitely{{else}}{{.Until}}{{end}}</td><td>{{.Policy}}</td><td>{{.Reason}}</td></tr>
+{{else}}
+<tr><td colspan="5">No participant is suspended.</td></tr>
+{{end}}
+</table>
+<h2>Suspend or lift</h2>
+<form action="/suspension" method="post" onchange="updateSuspension()">
+<select id="action" name="action"><option>suspend</option><option>lift</option></select><br/>
+<input id="participant" type="text" name="participant" placeholder="Participant" size="50" /><br/>
+<input id="reason" type="text" name="reason" placeholder="Reason" size="80" /><br/>
+<select id="policy" name="policy"><option>finish</option><option>refund</option></select> active transactions<br/>
+<input id="until" type="text" name="until" placeholder="Until (RFC 3339, empty for indefinitely)" size="50" /><br/>
+<input id="nonce" type="hidden" name="nonce" onchange="updateSuspension()"/>
+<input type="text" name="signature" size="80" placeholder="Signature of query using the admin account" />
+<input type="submit" />
+</form>
+Sign this text using the admin account to confirm:<br />
+<input id="query" type="text" size="100" value="" onclick="select()" readonly/>
+<h2>Audit log{{if .Participant}} of {{.Participant}}{{end}}</h2>
+<table>
+<tr><th>Time</th><th>Action</th><th>Participant</th><th>Subject</th><th>Details</th></tr>
+{{range .Audit}}
+<tr><td>{{.Time}}</td><td>{{.Action}}</td><td>{{.Participant}}</td><td>{{.Subject}}</td><td>{{.Details}}</td></tr>
+{{end}}
+</table>
+<script>
+function updateSuspension() {
+    var q = "";
+    // Arguments must appear in alphabetical order
+    q = append(q, "action");
+    q = append(q, "nonce");
+    q = append(q, "participant");
+    q = append(q, "policy");
+    q = appendText(q, "reason");
+    q = append(q, "until");
+    document.getElementById("query").value = q;
+}
+</script>
+</body>
+</html>
+`
+
+var suspensionTemplate = template.Must(template.New("suspension").Parse(suspensionHtml))
+
+// Number of audit log entries shown on the suspension page
+const auditLogEntriesShown = 100
+
+// Returns an error if the participant is suspended and may therefore not place bids.
+func checkNotSuspended(c context.Context, participant string) error {
+	if suspension, err := db.GetSuspension(c, participant, time.Now()); err != nil {
+		return err
+	} else if suspension != nil {
+		return &apiError{http.StatusForbidden, "suspended",
+			fmt.Sprintf("Participant %v is suspended: %v", participant, suspension.Reason), "", nil}
+	}
+	return nil
+}
+
+// Handler function for /suspension. GET lists the suspensions and the audit log,
+// optionally restricted to a participant. POST suspends a participant or lifts a
+// suspension, as signed by the admin.
+func handleSuspension(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Method == "POST" {
+		if err := updateSuspension(c, r); err != nil {
+			log.Warningf(c, "updateSuspension failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Redirect(w, r, "/suspension", http.StatusSeeOther)
+		}
+	} else if r.Method == "GET" {
+		participant := r.FormValue("participant")
+		if suspensions, err := db.QuerySuspensions(c); err != nil {
+			log.Errorf(c, "Error querying suspensions: %v", err)
+			http.Error(w, "Error querying suspensions", http.StatusInternalServerError)
+		} else if audit, err := db.QueryAuditLog(c, participant, auditLogEntriesShown); err != nil {
+			log.Errorf(c, "Error querying audit log: %v", err)
+			http.Error(w, "Error querying audit log", http.StatusInternalServerError)
+		} else if err := suspensionTemplate.Execute(w, struct {
+			Participant string
+			Suspensions []db.Suspension
+			Audit       []db.AuditEntry
+		}{participant, suspensions, audit}); err != nil {
+			http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
+		}
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Suspends a participant or lifts a suspension. Suspending withdraws the participant's
+// unmatched bids and, depending on the policy, refunds the active transactions.
+func updateSuspension(c context.Context, r *http.Request) error {
+	values, document, signature, err := parseAdminRequest(c, r)
+	if err != nil {
+		return err
+	}
+
+	participant := values["participant"]
+	if err := util.CheckParticipantAddress(participant); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch action := values["action"]; action {
+	case "suspend":
+		suspension := db.Suspension{
+			Participant: participant,
+			Reason:      values["reason"],
+			Since:       now,
+			Document:    document,
+			Signature:   signature,
+		}
+		if suspension.Reason == "" {
+			return fmt.Errorf("A reason must be given")
+		}
+		if suspension.Policy, err = db.ParseSuspensionPolicy(values["policy"]); err != nil {
+			return err
+		}
+		if until := values["until"]; until != "" {
+			if suspension.Until, err = time.Parse(time.RFC3339, until); err != nil {
+				return fmt.Errorf("Invalid until: %v", err)
+			} else if !suspension.Until.After(now) {
+				return fmt.Errorf("Until must lie in the future")
+			}
+		}
+
+		log.Infof(c, "Suspending %v (%v): %v", participant, suspension.Policy, suspension.Reason)
+		if err := db.Suspend(c, &suspension); err != nil {
+			return err
+		}
+		if n, err := db.WithdrawBids(c, participant, now, document, signature); err != nil {
+			return fmt.Errorf("Error withdrawing bids: %v", err)
+		} else {
+			log.Infof(c, "Withdrew %v bids of %v", n, participant)
+		}
+		if suspension.Policy == db.SuspensionRefund {
+			if n, err := db.RefundTransactions(c, participant, now, document, signature); err != nil {
+				return fmt.Errorf("Error refunding transactions: %v", err)
+			} else {
+				log.Infof(c, "Refunded %v transactions of %v", n, participant)
+			}
+		}
+		return nil
+	case "lift":
+		log.Infof(c, "Lifting suspension of %v", participant)
+		return db.LiftSuspension(c, participant, now, document, signature)
+	default:
+		return fmt.Errorf("Invalid action: %#v", action)
+	}
+}
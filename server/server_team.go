@@ -0,0 +1,196 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/indyjo/bitwrk-common/money"
+	"github.com/indyjo/bitwrk/server/config"
+	db "github.com/indyjo/bitwrk/server/gae"
+	"github.com/indyjo/bitwrk/server/util"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const teamCreateHtml = `
+<!doctype html>
+<html>
+<head><title>Define Team</title></head>
+<script src="/js/getnonce.js" ></script>
+<body onload="getnonce()">
+<form action="/team" method="post">
+<input id="organization" type="text" name="organization" size="50" placeholder="Organization's Bitcoin address" onchange="update()"/> &larr; Account the members may bid against<br/>
+<textarea id="members" name="members" rows="5" cols="80" placeholder="address:dailylimit:totallimit, e.g. 1Abc...:mBTC10:mBTC100, one per line" onchange="update()"></textarea><br/>
+<input id="nonce" type="hidden" name="nonce" onchange="update()"/>
+<input type="text" name="signature" size="80" placeholder="Signature of query parameters using organization's address" />
+<input type="submit" />
+</form>
+<br />
+Sign this text to confirm the team:<br />
+<input id="query" type="text" size="100" value="" onclick="select()" readonly/>
+<script>
+function update() {
+    var q = "organization=" + encodeURIComponent(document.getElementById("organization").value.replace(/\s+/g, ''));
+    var members = document.getElementById("members").value.split(/[\s,]+/).filter(function(m) { return m != ""; });
+    q = q + "&members=" + encodeURIComponent(members.join(","));
+    q = q + "&nonce=" + encodeURIComponent(document.getElementById("nonce").value);
+    document.getElementById("query").value = q;
+}
+</script>
+</body>
+</html>
+`
+
+var teamCreateTemplate = template.Must(template.New("teamCreate").Parse(teamCreateHtml))
+
+// Maximum number of members a team may have
+const maxTeamMembers = 100
+
+// Handler function for /team
+func handleTeam(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		if err := teamCreateTemplate.Execute(w, nil); err != nil {
+			http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
+		}
+	} else if r.Method == "POST" {
+		c := appengine.NewContext(r)
+		if err := r.ParseForm(); err != nil {
+			log.Errorf(c, "Couldn't parse form data: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := checkMaintenance(c); err != nil {
+			writeLegacyError(w, err.Error(), err)
+			return
+		}
+		if organization, err := storeTeam(c, r); err != nil {
+			log.Warningf(c, "storeTeam failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Redirect(w, r, "/account/"+organization, http.StatusSeeOther)
+		}
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Stores the member list of a team, as signed by the organization. The document
+// has the form "organization=<address>&members=<members>&nonce=<nonce>", where
+// members is a comma-separated list of "<address>:<daily limit>:<total limit>".
+func storeTeam(c context.Context, r *http.Request) (organization string, err error) {
+	organization = strings.TrimSpace(r.FormValue("organization"))
+	members := normalizeTeamMembers(r.FormValue("members"))
+	nonce := r.FormValue("nonce")
+	signature := r.FormValue("signature")
+
+	// Important: checking (and invalidating) the nonce must be the first thing we do!
+	err = checkNonce(c, nonce)
+	if config.CfgRequireValidNonce && err != nil {
+		return "", fmt.Errorf("Error in checkNonce: %v", err)
+	}
+
+	if err = util.CheckParticipantAddress(organization); err != nil {
+		return
+	}
+
+	team := db.Team{
+		Organization: organization,
+		Document: fmt.Sprintf("organization=%v&members=%v&nonce=%v",
+			url.QueryEscape(organization), url.QueryEscape(members), url.QueryEscape(nonce)),
+		Signature: signature,
+		Updated:   time.Now(),
+	}
+
+	if team.Members, err = parseTeamMembers(organization, members); err != nil {
+		return
+	}
+
+	if config.CfgRequireValidSignature {
+		if err = util.VerifySignature(team.Document, organization, signature); err != nil {
+			return
+		}
+	}
+
+	err = db.SaveTeam(c, &team)
+	return
+}
+
+// Brings a member list as entered into the form, i.e. separated by whitespace or
+// commas, into the comma-separated form that is signed (see update() in teamCreateHtml).
+func normalizeTeamMembers(members string) string {
+	return strings.Join(strings.FieldsFunc(members, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}), ",")
+}
+
+func parseTeamMembers(organization, members string) ([]db.TeamMember, error) {
+	result := make([]db.TeamMember, 0, 4)
+	if members == "" {
+		return result, nil
+	}
+
+	for _, entry := range strings.Split(members, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Invalid member %#v, expected <address>:<daily limit>:<total limit>", entry)
+		}
+
+		m := db.TeamMember{Address: parts[0]}
+		if err := util.CheckParticipantAddress(m.Address); err != nil {
+			return nil, err
+		} else if m.Address == organization {
+			return nil, fmt.Errorf("Organization can't be a member of its own team")
+		} else if m.DailyLimit, err = parseLimit(parts[1]); err != nil {
+			return nil, err
+		} else if m.TotalLimit, err = parseLimit(parts[2]); err != nil {
+			return nil, err
+		}
+
+		for _, other := range result {
+			if other.Address == m.Address {
+				return nil, fmt.Errorf("Duplicate member %v", m.Address)
+			}
+		}
+		result = append(result, m)
+	}
+
+	if len(result) > maxTeamMembers {
+		return nil, fmt.Errorf("A team may not have more than %v members", maxTeamMembers)
+	}
+
+	return result, nil
+}
+
+func parseLimit(s string) (money.Money, error) {
+	if limit, err := money.Parse(s); err != nil {
+		return limit, err
+	} else if limit.Currency != money.BTC {
+		return limit, fmt.Errorf("Spending limits must be given in BTC")
+	} else if limit.Amount < 0 {
+		return limit, fmt.Errorf("Spending limits must not be negative")
+	} else {
+		return limit, nil
+	}
+}
@@ -0,0 +1,38 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestNormalizeTeamMembers(t *testing.T) {
+	expect := func(members, expected string) {
+		if actual := normalizeTeamMembers(members); actual != expected {
+			t.Errorf("Expected: normalizeTeamMembers(%#v) = %#v  --  Got: %#v", members, expected, actual)
+		}
+	}
+
+	expect("", "")
+	expect(" \n ", "")
+	expect("1Abc:mBTC10:mBTC100", "1Abc:mBTC10:mBTC100")
+	// One per line, as asked for by the form
+	expect("1Abc:mBTC10:mBTC100\n1Def:mBTC1:mBTC2\n", "1Abc:mBTC10:mBTC100,1Def:mBTC1:mBTC2")
+	expect("1Abc:mBTC10:mBTC100\r\n\r\n1Def:mBTC1:mBTC2", "1Abc:mBTC10:mBTC100,1Def:mBTC1:mBTC2")
+	// Separated by commas and blanks, as the form's script accepts them
+	expect("1Abc:mBTC10:mBTC100, 1Def:mBTC1:mBTC2,,\t1Ghi:BTC1:BTC1", "1Abc:mBTC10:mBTC100,1Def:mBTC1:mBTC2,1Ghi:BTC1:BTC1")
+}
@@ -24,12 +24,13 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"bitbucket.org/ww/goautoneg"
-	"github.com/indyjo/bitwrk-common/bitcoin"
 	"github.com/indyjo/bitwrk-common/bitwrk"
+	"github.com/indyjo/bitwrk-common/money"
 	"github.com/indyjo/bitwrk/server/config"
 	db "github.com/indyjo/bitwrk/server/gae"
 	"github.com/indyjo/bitwrk/server/util"
@@ -50,7 +51,16 @@ const txViewHtml = `
 <tr><th>Bids</th><td><a href="/bid/{{.Tx.BuyerBid}}">Buyer</a></td><td><a href="/bid/{{.Tx.SellerBid}}">Seller</a></td></tr>
 <tr><th>Addresses</th><td><a href="/account/{{.Tx.Buyer}}">{{.Tx.Buyer}}</a></td><td><a href="/account/{{.Tx.Seller}}">{{.Tx.Seller}}</a></td></tr>
 <tr><th>Price</th><td colspan="2">{{.Tx.Price}}</td></tr>
+{{if .Ext.PriceRule}}
+<tr><th>Price rule</th><td colspan="2">{{.Ext.PriceRule}}</td></tr>
+{{end}}
 <tr><th>Phase</th><td colspan="2">{{.Tx.Phase}}</td></tr>
+{{if .Ext.Dispute}}
+<tr><th>Dispute</th><td colspan="2">{{.Ext.Dispute}} since {{.Ext.DisputeOpened}}</td></tr>
+{{if eq .Ext.Dispute "settled"}}
+<tr><th>Seller's share</th><td colspan="2">{{.Ext.SellerShare}}</td></tr>
+{{end}}
+{{end}}
 {{if .Tx.WorkerURL}}
 <tr><th>Worker's URL</th><td colspan="2">{{.Tx.WorkerURL}}</td></tr>
 {{end}}
@@ -60,6 +70,7 @@ const txViewHtml = `
 
 {{if .Messages}}
 <h1>Received Messages</h1>
+<a href="/tx/{{.Id}}/messages">Full history, including rejected messages (JSON)</a>
 <table>
 <tr>
 <th>Received</th>
@@ -164,6 +175,46 @@ const txViewHtml = `
 <td><input type="submit" /></td>
 </form>
 </tr>
+
+<tr>
+<form action="/tx/{{.Id}}" method="POST">
+<th>Either</th>
+<td><input type="text" name="address" placeholder="Buyer's or seller's address"/></td>
+<td colspan="2"><input id="evidence" type="text" name="evidence" size="60" placeholder="Evidence, e.g. hashes of sample outputs" onchange="update()"/></td>
+<td><input type="signature" name="signature" placeholder="Paste signature here"/></td>
+<td><input type="submit" /></td>
+</form>
+</tr>
+
+{{if eq .Ext.Dispute "open"}}
+<tr>
+<form action="/tx/{{.Id}}" method="POST">
+<th>Arbiter</th>
+<input type="hidden" name="address" value="{{.Arbiter}}" />
+<td><input id="sellershare" type="text" name="sellershare" placeholder="Seller's share of the price" onchange="update()"/></td>
+<td/>
+<td/>
+<td><input type="signature" name="signature" placeholder="Paste signature here"/></td>
+<td><input type="submit" /></td>
+</form>
+</tr>
+{{end}}
+
+<tr>
+<form action="/tx/{{.Id}}" method="POST">
+<th>Both</th>
+<td><select id="agreement" name="agreement" onchange="update()">
+<option value="">Agreement...</option>
+<option value="extend">Extend deadline</option>
+<option value="cancel">Cancel with refund</option>
+</select></td>
+<td><input id="minutes" type="text" name="minutes" placeholder="Minutes (extend only)" onchange="update()"/></td>
+<td><input id="revision" type="text" name="revision" placeholder="Revision ({{.Tx.Revision}})" onchange="update()"/></td>
+<td><input type="signature" name="buyersignature" placeholder="Buyer's signature"/>
+<input type="signature" name="sellersignature" placeholder="Seller's signature"/></td>
+<td><input type="submit" /></td>
+</form>
+</tr>
 </table>
 
 </body>
@@ -174,6 +225,11 @@ var txViewTemplate = template.Must(template.New("txView").Parse(txViewHtml))
 
 // Handler for /tx/* URLs
 func handleTx(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/messages") {
+		handleTxMessages(w, r, strings.TrimSuffix(r.URL.Path[4:], "/messages"))
+		return
+	}
+
 	if r.Method != "GET" && r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -199,13 +255,15 @@ func handleTx(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var tx *bitwrk.Transaction
+	var ext *db.TxExtension
 	var messages []bitwrk.Tmessage
 	if r.Method == "POST" {
-		err = updateTransaction(c, r, txId, txKey)
+		r.ParseForm()
+		err = updateTransaction(c, r.Form, util.ClientAddr(r), r.UserAgent(), txId, txKey)
 		if err != nil {
 			message := fmt.Sprintf("Couldn't update transaction %#v: %v", txId, err)
 			log.Warningf(c, "%v", message)
-			http.Error(w, message, http.StatusInternalServerError)
+			writeLegacyError(w, message, err)
 		} else {
 			redirectToTransaction(txId, w, r)
 		}
@@ -213,7 +271,7 @@ func handleTx(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// GET only
-	tx, err = db.GetTransaction(c, txKey)
+	tx, ext, err = db.GetTransaction(c, txKey)
 	if err != nil {
 		log.Warningf(c, "Datastore lookup failed for tx id: '%v'", txId)
 		log.Warningf(c, "Reason: %v", err)
@@ -235,9 +293,9 @@ func handleTx(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("ETag", etag)
 	w.Header().Set("X-ETag", etag)
 	if contentType == "application/json" {
-		err = renderTxJson(w, txId, tx)
+		err = renderTxJson(w, txId, tx, ext)
 	} else {
-		err = renderTxHtml(w, txId, tx, messages)
+		err = renderTxHtml(w, txId, tx, ext, messages)
 	}
 
 	if err != nil {
@@ -245,6 +303,50 @@ func handleTx(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Handler for /tx/<txid>/messages. Returns a page of the transaction's messages as JSON,
+// including rejected ones. Parameters "limit" (default 100) and "cursor" control paging.
+// The returned cursor is empty when the last page has been reached.
+func handleTxMessages(w http.ResponseWriter, r *http.Request, txId string) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := appengine.NewContext(r)
+	txKey, err := datastore.DecodeKey(txId)
+	if err != nil {
+		log.Warningf(c, "Illegal tx id queried: '%v'", txId)
+		http.Error(w, "Transaction not found: "+txId, http.StatusNotFound)
+		return
+	}
+
+	limit := 100
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err != nil || l < 1 || l > 1000 {
+			http.Error(w, "Limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		} else {
+			limit = l
+		}
+	}
+
+	messages, cursor, err := db.QueryTransactionMessages(c, txKey, r.FormValue("cursor"), limit)
+	if err != nil {
+		log.Warningf(c, "Couldn't query messages of tx %v: %v", txId, err)
+		http.Error(w, "Error querying messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Messages []bitwrk.Tmessage
+		Cursor   string
+	}{messages, cursor})
+	if err != nil {
+		log.Errorf(c, "Error rendering %v: %v", r.URL, err)
+	}
+}
+
 func redirectToTransaction(txId string, w http.ResponseWriter, r *http.Request) {
 	txUrl, _ := url.Parse("/tx/" + txId)
 	txUrl = r.URL.ResolveReference(txUrl)
@@ -252,17 +354,41 @@ func redirectToTransaction(txId string, w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusSeeOther)
 }
 
-func renderTxHtml(w http.ResponseWriter, txId string, tx *bitwrk.Transaction, messages []bitwrk.Tmessage) (err error) {
+func renderTxHtml(w http.ResponseWriter, txId string, tx *bitwrk.Transaction, ext *db.TxExtension, messages []bitwrk.Tmessage) (err error) {
 	type context struct {
 		Id       string
 		Tx       *bitwrk.Transaction
+		Ext      *db.TxExtension
 		Messages []bitwrk.Tmessage
+		Arbiter  string
 	}
-	return txViewTemplate.Execute(w, context{txId, tx, messages})
+	return txViewTemplate.Execute(w, context{txId, tx, ext, messages, config.CfgArbiterAccount})
 }
 
-func renderTxJson(w http.ResponseWriter, txId string, tx *bitwrk.Transaction) (err error) {
-	return json.NewEncoder(w).Encode(*tx)
+// The fields of a transaction's server-side extension that are shown to clients.
+// Bookkeeping, such as fees and price statistics, stays internal.
+type publicTxExtension struct {
+	PriceRule   db.PriceRule
+	Dispute     db.DisputeState
+	SellerShare *money.Money `json:",omitempty"` // Only once a dispute has been settled
+}
+
+func newPublicTxExtension(ext *db.TxExtension) publicTxExtension {
+	result := publicTxExtension{PriceRule: ext.PriceRule, Dispute: ext.Dispute}
+	if ext.Dispute == db.DisputeSettled {
+		share := ext.SellerShare
+		result.SellerShare = &share
+	}
+	return result
+}
+
+// Renders the transaction as JSON. Public fields of the server-side extension are
+// added to those of the transaction.
+func renderTxJson(w http.ResponseWriter, txId string, tx *bitwrk.Transaction, ext *db.TxExtension) (err error) {
+	return json.NewEncoder(w).Encode(struct {
+		bitwrk.Transaction
+		publicTxExtension
+	}{*tx, newPublicTxExtension(ext)})
 }
 
 // Creates a canonical representation of the passed arguments (the document),
@@ -284,26 +410,28 @@ func makeDocument(m map[string]string) string {
 	return strings.Join(arguments, "&")
 }
 
-func updateTransaction(c context.Context, r *http.Request, txId string, txKey *datastore.Key) error {
+// Sends a message, given by its request parameters, to a transaction. Validation
+// failures are returned as *apiError. The remote address is used for checking the
+// "workerurl" parameter, the user agent for checking the client's version.
+func updateTransaction(c context.Context, form url.Values, remoteAddr, userAgent string, txId string, txKey *datastore.Key) error {
 	now := time.Now()
 
-	r.ParseForm()
 	values := make(map[string]string)
 
 	// Check that we don't have any multi-occurring parameters,
 	// copy into a simple key value map for easier handling
-	for k, v := range r.Form {
+	for k, v := range form {
 		if len(v) == 1 {
 			values[k] = v[0]
 		} else if len(v) > 1 {
-			return fmt.Errorf("Multiple occurrences of argument %#v", k)
+			return badRequest(k, "Multiple occurrences of argument %#v", k)
 		}
 	}
 
 	// Verify "txid" parameter, add if not found
 	if txId2, ok := values["txid"]; ok {
 		if txId2 != txId {
-			return fmt.Errorf("Transaction ID parameter doesn't match %#v", txId)
+			return badRequest("txid", "Transaction ID parameter doesn't match %#v", txId)
 		}
 	} else {
 		values["txid"] = txId
@@ -313,22 +441,36 @@ func updateTransaction(c context.Context, r *http.Request, txId string, txKey *d
 	if config.CfgRequireValidWorkerURL {
 		if rawurl, ok := values["workerurl"]; !ok {
 		} else if len(rawurl) >= 256 {
-			return fmt.Errorf("WorkerURL may not exceed 255 characters")
+			return badRequest("workerurl", "WorkerURL may not exceed 255 characters")
 		} else if u, err := url.Parse(rawurl); err != nil {
+			return badRequest("workerurl", "%v", err)
+		} else if util.StripPort(u.Host) != util.StripPort(remoteAddr) {
+			return badRequest("workerurl", "workerurl host %v (rawurl=%v) and remote host %v do not match.",
+				u.Host, rawurl, remoteAddr)
+		}
+	}
+
+	// Outdated clients may not take part in transactions on articles requiring a newer version
+	if _, ok := util.ClientVersionFromUserAgent(userAgent); ok {
+		if tx, _, err := db.GetTransaction(c, txKey); err != nil {
+			return err
+		} else if err := checkClientVersion(userAgent, string(tx.Article)); err != nil {
 			return err
-		} else if util.StripPort(u.Host) != util.StripPort(r.RemoteAddr) {
-			return fmt.Errorf("workerurl host %v (rawurl=%v) and remote host %v do not match.",
-				u.Host, rawurl, r.RemoteAddr)
 		}
 	}
 
+	// Agreements carry signatures of both parties and are handled separately
+	if _, ok := values["agreement"]; ok {
+		return agreeOnTransaction(c, values, txKey)
+	}
+
 	// Filter out "signature" parameter
 	var signature string
 	if _signature, ok := values["signature"]; ok {
 		delete(values, "signature")
 		signature = _signature
 	} else {
-		return fmt.Errorf("Missing signature parameter in message")
+		return badRequest("signature", "Missing signature parameter in message")
 	}
 
 	// Filter out "address" parameter
@@ -337,22 +479,111 @@ func updateTransaction(c context.Context, r *http.Request, txId string, txKey *d
 		delete(values, "address")
 		address = _address
 	} else {
-		return fmt.Errorf("Missing address parameter in message")
+		return badRequest("address", "Missing address parameter in message")
 	}
 
 	document := makeDocument(values)
 	if config.CfgRequireValidSignature {
-		if err := bitcoin.VerifySignatureBase64(document, address, signature); err != nil {
-			return err
+		if err := util.VerifySignature(document, address, signature); err != nil {
+			return signatureError(err)
 		}
 	}
 
 	// no need for txid in values anymore
 	delete(values, "txid")
 
+	// Disputes are handled outside of the transaction's regular phases
+	if evidence, ok := values["evidence"]; ok {
+		if len(values) != 1 {
+			return badRequest("evidence", "Evidence must be sent in a message of its own")
+		} else if len(evidence) > db.MaxEvidenceLength {
+			return badRequest("evidence", "Evidence may not exceed %v characters", db.MaxEvidenceLength)
+		}
+		return db.SubmitEvidence(c, txKey, now, address, document, signature)
+	} else if share, ok := values["sellershare"]; ok {
+		if address != config.CfgArbiterAccount {
+			return &db.PermissionError{Message: "Only the arbiter may settle a dispute"}
+		} else if len(values) != 1 {
+			return badRequest("sellershare", "A settlement must be sent in a message of its own")
+		}
+		if sellerShare, err := money.Parse(share); err != nil {
+			return badRequest("sellershare", "%v", err)
+		} else {
+			return db.SettleDispute(c, txKey, now, sellerShare, document, signature)
+		}
+	}
+
+	// Make sure the buyer will be able to reach the seller's worker
+	if workerURL, ok := values["workerurl"]; ok && config.CfgProbeWorkerURL {
+		if err := probeWorkerURL(c, workerURL); err != nil {
+			return err
+		}
+	}
+
 	if err := db.UpdateTransaction(c, txKey, now, address, values, document, signature); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Handles a message that takes effect only if both buyer and seller have signed it.
+// Expected arguments besides "agreement" and "txid" are "revision" (the transaction's
+// current revision), "minutes" (for extensions only), as well as "buyeraddress",
+// "buyersignature", "selleraddress" and "sellersignature". The addresses default to
+// the transaction's buyer and seller.
+func agreeOnTransaction(c context.Context, values map[string]string, txKey *datastore.Key) error {
+	agreement := db.TxAgreement{
+		Type:            values["agreement"],
+		BuyerAddress:    values["buyeraddress"],
+		BuyerSignature:  values["buyersignature"],
+		SellerAddress:   values["selleraddress"],
+		SellerSignature: values["sellersignature"],
+	}
+	for _, k := range []string{"buyeraddress", "buyersignature", "selleraddress", "sellersignature"} {
+		delete(values, k)
+	}
+
+	if revision, err := strconv.Atoi(values["revision"]); err != nil {
+		return badRequest("revision", "Invalid revision: %v", err)
+	} else {
+		agreement.Revision = revision
+	}
+
+	if agreement.Type == db.AgreementExtend {
+		if minutes, err := strconv.Atoi(values["minutes"]); err != nil {
+			return badRequest("minutes", "Invalid number of minutes: %v", err)
+		} else if extension := time.Duration(minutes) * time.Minute; extension <= 0 || extension > db.MaxAgreedExtension {
+			return badRequest("minutes", "Extension must be positive and may not exceed %v", db.MaxAgreedExtension)
+		} else {
+			agreement.Extension = extension
+		}
+	} else if agreement.Type != db.AgreementCancel {
+		return badRequest("agreement", "Unknown agreement: %#v", agreement.Type)
+	}
+
+	if agreement.BuyerAddress == "" || agreement.SellerAddress == "" {
+		if tx, _, err := db.GetTransaction(c, txKey); err != nil {
+			return err
+		} else {
+			if agreement.BuyerAddress == "" {
+				agreement.BuyerAddress = tx.Buyer
+			}
+			if agreement.SellerAddress == "" {
+				agreement.SellerAddress = tx.Seller
+			}
+		}
+	}
+
+	agreement.Document = makeDocument(values)
+	if config.CfgRequireValidSignature {
+		if err := util.VerifySignature(agreement.Document, agreement.BuyerAddress, agreement.BuyerSignature); err != nil {
+			return badRequest("buyersignature", "Buyer's signature: %v", err)
+		}
+		if err := util.VerifySignature(agreement.Document, agreement.SellerAddress, agreement.SellerSignature); err != nil {
+			return badRequest("sellersignature", "Seller's signature: %v", err)
+		}
+	}
+
+	return db.AgreeOnTransaction(c, txKey, time.Now(), &agreement)
+}
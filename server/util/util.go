@@ -20,29 +20,96 @@ package util
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/indyjo/bitwrk-common/bitcoin"
 	"github.com/indyjo/bitwrk/server/config"
+	"github.com/indyjo/bitwrk/server/segwit"
 )
 
+// Address formats used by a Bitcoin network
+type bitcoinNetwork struct {
+	networkId    byte   // Version byte of legacy (base58) addresses
+	bech32Prefix string // Human-readable part of native SegWit addresses
+}
+
+var bitcoinNetworks = map[string]bitcoinNetwork{
+	"mainnet": {0, segwit.HrpMainnet},
+	"testnet": {111, segwit.HrpTestnet},
+	"regtest": {111, segwit.HrpRegtest},
+}
+
+func currentNetwork() bitcoinNetwork {
+	if network, ok := bitcoinNetworks[config.CfgBitcoinNetwork]; ok {
+		return network
+	}
+	panic(fmt.Errorf("Unknown bitcoin network %#v", config.CfgBitcoinNetwork))
+}
+
+// Returns whether address is a native SegWit (bech32) address of the configured network.
+func IsSegwitAddress(address string) bool {
+	return segwit.HasPrefix(address, currentNetwork().bech32Prefix)
+}
+
 // Check whether a bitcoin address is from the 'right' network,
-// i.e. main or test network (depends on config)
+// i.e. main or test network (depends on config). Both legacy and
+// native SegWit addresses are accepted.
 func CheckBitcoinAddress(address string) error {
+	network := currentNetwork()
+	if IsSegwitAddress(address) {
+		_, err := segwit.DecodeAddress(address, network.bech32Prefix)
+		return err
+	}
+
 	networkId, _, err := bitcoin.DecodeBitcoinAddress(address)
 	if err != nil {
 		return err
 	}
 
-	if networkId != config.CfgBitcoinNetworkId {
+	if networkId != network.networkId {
 		return fmt.Errorf("Invalid bitcoin network id %v in address %#v."+
-			" This server accepts %v.", networkId, address, config.CfgBitcoinNetworkId)
+			" This server accepts %v.", networkId, address, network.networkId)
+	}
+
+	return nil
+}
+
+// Like CheckBitcoinAddress, but only accepts addresses that participants can sign
+// messages with: Legacy addresses and P2WPKH addresses in lower case.
+func CheckParticipantAddress(address string) error {
+	if !IsSegwitAddress(address) {
+		return CheckBitcoinAddress(address)
+	}
+
+	if addr, err := segwit.DecodeAddress(address, currentNetwork().bech32Prefix); err != nil {
+		return err
+	} else if !addr.IsP2WPKH() {
+		return fmt.Errorf("Only P2WPKH SegWit addresses can be used by participants: %#v", address)
+	} else if strings.ToLower(address) != address {
+		return fmt.Errorf("SegWit addresses must be given in lower case: %#v", address)
 	}
 
 	return nil
 }
 
+// Verifies a message signature. Legacy addresses use Bitcoin's classic signed-message
+// scheme, SegWit addresses a BIP-322 simple signature.
+func VerifySignature(document, address, signature string) error {
+	if !IsSegwitAddress(address) {
+		return bitcoin.VerifySignatureBase64(document, address, signature)
+	}
+
+	if addr, err := segwit.DecodeAddress(address, currentNetwork().bech32Prefix); err != nil {
+		return err
+	} else {
+		return segwit.VerifySimpleSignature(document, addr, signature)
+	}
+}
+
 var blenderRegexp = regexp.MustCompile(`^(net\.bitwrk/blender/0/2\.(69|7[0-9])/(512M|2G|8G|32G))$`)
 
 func CheckArticle(_ context.Context, article string) error {
@@ -78,3 +145,116 @@ func StripPort(hostport string) string {
 		return hostport
 	}
 }
+
+// A version of the BitWrk client, such as 0.6.4.
+type ClientVersion struct {
+	Major, Minor, Micro int
+}
+
+var versionRegexp = regexp.MustCompile("^([0-9]{1,4})\\.([0-9]{1,4})\\.([0-9]{1,4})")
+
+// Parses a version given as "major.minor.micro".
+func ParseClientVersion(s string) (ClientVersion, error) {
+	matches := versionRegexp.FindStringSubmatch(s)
+	if matches == nil || len(matches[0]) != len(s) {
+		return ClientVersion{}, fmt.Errorf("Invalid version: %#v", s)
+	}
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	micro, _ := strconv.Atoi(matches[3])
+	return ClientVersion{major, minor, micro}, nil
+}
+
+// Returns the client version contained in the HTTP "User-Agent" header sent by the
+// BitWrk client, e.g. "BitWrkGoClient/0.6.4". Returns false for other user agents.
+func ClientVersionFromUserAgent(userAgent string) (ClientVersion, bool) {
+	const prefix = "BitWrkGoClient/"
+	if !strings.HasPrefix(userAgent, prefix) {
+		return ClientVersion{}, false
+	}
+	matches := versionRegexp.FindString(userAgent[len(prefix):])
+	if v, err := ParseClientVersion(matches); err != nil {
+		return ClientVersion{}, false
+	} else {
+		return v, true
+	}
+}
+
+// Returns whether v is an older version than other.
+func (v ClientVersion) Less(other ClientVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	} else if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Micro < other.Micro
+}
+
+func (v ClientVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+}
+
+// Returns whether the given host is one of the reverse proxies listed in CfgTrustedProxies.
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range config.CfgTrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIp := net.ParseIP(proxy); proxyIp != nil && proxyIp.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the hosts listed in a request's "Forwarded" header, or in its "X-Forwarded-For"
+// header if there is no "Forwarded" header, in the order the proxies added them.
+func forwardedHosts(r *http.Request) []string {
+	var hosts []string
+	if values := r.Header["Forwarded"]; len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+						hosts = append(hosts, StripPort(strings.Trim(pair[4:], `"`)))
+					}
+				}
+			}
+		}
+		return hosts
+	}
+	for _, value := range r.Header["X-Forwarded-For"] {
+		for _, host := range strings.Split(value, ",") {
+			hosts = append(hosts, StripPort(strings.TrimSpace(host)))
+		}
+	}
+	return hosts
+}
+
+// Returns the address of the client that sent a request, without port. If the request
+// was received from a trusted proxy, the address is taken from the forwarding headers,
+// skipping any further trusted proxies. Otherwise, it is the connection's address.
+func ClientAddr(r *http.Request) string {
+	host := StripPort(r.RemoteAddr)
+	if !isTrustedProxy(host) {
+		return host
+	}
+	hosts := forwardedHosts(r)
+	for i := len(hosts) - 1; i >= 0; i-- {
+		if hosts[i] == "" {
+			// Malformed or obfuscated entry, so the chain can't be followed any further
+			break
+		}
+		host = hosts[i]
+		if !isTrustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
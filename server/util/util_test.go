@@ -1,7 +1,10 @@
 package util
 
 import (
+	"net/http"
 	"testing"
+
+	"github.com/indyjo/bitwrk/server/config"
 )
 
 func TestStripPort(t *testing.T) {
@@ -17,3 +20,86 @@ func TestStripPort(t *testing.T) {
 	expect("2a01:4f8:141:322c::2", "2a01:4f8:141:322c::2")
 	expect("[2a01:4f8:141:322c::2]:8082", "2a01:4f8:141:322c::2")
 }
+
+func TestCheckSegwitAddress(t *testing.T) {
+	expect := func(f func(string) error, address string, valid bool) {
+		if err := f(address); valid && err != nil {
+			t.Errorf("Expected %#v to be accepted, got: %v", address, err)
+		} else if !valid && err == nil {
+			t.Errorf("Expected %#v to be rejected", address)
+		}
+	}
+
+	// P2WPKH may be used both for deposits and by participants
+	expect(CheckBitcoinAddress, "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l", true)
+	expect(CheckParticipantAddress, "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l", true)
+	expect(CheckParticipantAddress, "BC1Q9VZA2E8X573NCZRLZMS0WVX3GSQJX7VAVGKX0L", false)
+
+	// Taproot addresses can receive deposits, but participants can't sign with them
+	expect(CheckBitcoinAddress, "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", true)
+	expect(CheckParticipantAddress, "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", false)
+
+	// Checksum error
+	expect(CheckBitcoinAddress, "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0m", false)
+}
+
+func TestClientVersion(t *testing.T) {
+	expect := func(userAgent string, expected string) {
+		if v, ok := ClientVersionFromUserAgent(userAgent); expected == "" && ok {
+			t.Errorf("Expected no version in %#v, got %v", userAgent, v)
+		} else if expected != "" && (!ok || v.String() != expected) {
+			t.Errorf("Expected version %v in %#v, got %v (%v)", expected, userAgent, v, ok)
+		}
+	}
+
+	expect("BitWrkGoClient/0.6.4", "0.6.4")
+	expect("BitWrkGoClient/1.12.0 (linux)", "1.12.0")
+	expect("BitWrkGoClient/0.6", "")
+	expect("Mozilla/5.0", "")
+
+	v := func(s string) ClientVersion {
+		if v, err := ParseClientVersion(s); err != nil {
+			t.Fatalf("Couldn't parse %#v: %v", s, err)
+			return v
+		} else {
+			return v
+		}
+	}
+	if !v("0.6.4").Less(v("0.10.0")) || v("0.10.0").Less(v("0.6.4")) || v("1.0.0").Less(v("1.0.0")) {
+		t.Errorf("Versions compared incorrectly")
+	}
+	if _, err := ParseClientVersion("1.2.3x"); err == nil {
+		t.Errorf("Expected trailing garbage to be rejected")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	saved := config.CfgTrustedProxies
+	defer func() { config.CfgTrustedProxies = saved }()
+	config.CfgTrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+
+	expect := func(remoteAddr string, header http.Header, result string) {
+		r := &http.Request{RemoteAddr: remoteAddr, Header: header}
+		if addr := ClientAddr(r); addr != result {
+			t.Errorf("Expected %#v from %#v with %v, got %#v", result, remoteAddr, header, addr)
+		}
+	}
+
+	// Forwarding headers are ignored unless the request comes from a trusted proxy
+	expect("1.2.3.4:5678", nil, "1.2.3.4")
+	expect("1.2.3.4:5678", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "1.2.3.4")
+	expect("10.1.2.3:80", nil, "10.1.2.3")
+	expect("10.1.2.3:80", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "5.6.7.8")
+	expect("[::1]:80", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "::1")
+
+	// Entries are followed from the right, as long as they are trusted proxies
+	expect("10.1.2.3:80", http.Header{"X-Forwarded-For": {"9.9.9.9, 5.6.7.8, 192.168.1.1"}}, "5.6.7.8")
+	expect("10.1.2.3:80", http.Header{"X-Forwarded-For": {"9.9.9.9", "10.0.0.1"}}, "9.9.9.9")
+
+	// Forwarded takes precedence over X-Forwarded-For
+	expect("192.168.1.1:80", http.Header{
+		"Forwarded":       {`for=5.6.7.8;proto=https, for="[2001:db8::1]:4711"`},
+		"X-Forwarded-For": {"9.9.9.9"},
+	}, "2001:db8::1")
+	expect("192.168.1.1:80", http.Header{"Forwarded": {"For=5.6.7.8:1234;by=10.0.0.1"}}, "5.6.7.8")
+}
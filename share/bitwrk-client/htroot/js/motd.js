@@ -38,7 +38,15 @@ function newMessageUpdater(alertbox, content) {
 						alertclass = "alert-info";
 					}
 
-					showAlertBox(alertbox, content, alertclass, motd.Text)
+					var html = motd.Text;
+					if (motd.Notices) {
+						for (var i = 0; i < motd.Notices.length; i++) {
+							var notice = motd.Notices[i];
+							html += "<br/><b>" + $("<span>").text(notice.Article).html() + ":</b> " + notice.Text;
+						}
+					}
+
+					showAlertBox(alertbox, content, alertclass, html)
 				}
 			}
 		};
@@ -7,5 +7,17 @@ function update() {
     q = q + "&address=" + encodeURIComponent(address.replace(/\s+/g, ''));
     var nonce = document.getElementById("nonce").value;
     q = q + "&nonce=" + encodeURIComponent(nonce.replace(/\s+/g, ''));
+    var account = document.getElementById("account").value.replace(/\s+/g, '');
+    if (account != "") {
+        q = q + "&account=" + encodeURIComponent(account);
+    }
+    var counterparty = document.getElementById("counterparty").value.replace(/\s+/g, '');
+    if (counterparty != "") {
+        q = q + "&counterparty=" + encodeURIComponent(counterparty);
+    }
+    var requestid = document.getElementById("requestid").value.replace(/\s+/g, '');
+    if (requestid != "") {
+        q = q + "&requestid=" + encodeURIComponent(requestid);
+    }
     document.getElementById("query").value = q;
 }
\ No newline at end of file
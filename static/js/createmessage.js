@@ -7,6 +7,19 @@ function append(str, id) {
     return str;
 }
 
+// Like append, but keeps inner whitespace. Escapes the same way the server does.
+function appendText(str, id) {
+    var e = document.getElementById(id);
+    if (e == null) return str;
+    var v = e.value.trim();
+    if (v == "") return str;
+    v = encodeURIComponent(v).replace(/[!'()*]/g, function(c) {
+        return "%" + c.charCodeAt(0).toString(16).toUpperCase();
+    }).replace(/%20/g, "+");
+    str = str + (str==""?"":"&") + id + "=" + v;
+    return str;
+}
+
 function appendCheck(str, id) {
     var e = document.getElementById(id);
     if (e == null || !e.checked) return str;
@@ -18,12 +31,17 @@ function update() {
     var q = "";
     // Arguments must appear in alphabetical order
     q = appendCheck(q, "acceptresult");
+    q = append(q, "agreement");
     q = append(q, "buyersecret");
     q = append(q, "encresulthash");
     q = append(q, "encresulthashsig");
     q = append(q, "encresultkey");
+    q = appendText(q, "evidence");
+    q = append(q, "minutes");
     q = appendCheck(q, "rejectresult");
     q = appendCheck(q, "rejectwork");
+    q = append(q, "revision");
+    q = append(q, "sellershare");
     q = append(q, "txid");
     q = append(q, "workerurl");
     q = append(q, "workhash");